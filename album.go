@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// albumMetadataName is the shared metadata file inside an album folder.
+const albumMetadataName = "album.json"
+
+// albumMetadata describes a deleted album: several messages sharing a
+// GroupedID, saved into one folder.
+type albumMetadata struct {
+	Version   int                `json:"version"`
+	GroupedID int64              `json:"grouped_id"`
+	Chat      chatMeta           `json:"chat"`
+	Date      time.Time          `json:"date"`
+	Text      string             `json:"text,omitempty"` // Album caption, taken from the item carrying it
+	Markdown  string             `json:"markdown,omitempty"`
+	Items     []*messageMetadata `json:"items"` // Ordered by message ID, like in the chat
+}
+
+var albumMux sync.Mutex
+
+// albumDirName returns the folder of an album inside the sender directory.
+// Items of an album may differ in their date, so only the grouped ID is used.
+func albumDirName(groupedID int64) string {
+	return fmt.Sprintf("album_%d", groupedID)
+}
+
+// addToAlbum merges the metadata of one album item into the album.json of
+// dir. Items saved by earlier runs are kept, so an album whose deletions
+// were split across runs ends up complete.
+func addToAlbum(dir string, meta *messageMetadata) error {
+	albumMux.Lock()
+	defer albumMux.Unlock()
+
+	path := filepath.Join(dir, albumMetadataName)
+	album, err := loadAlbum(path)
+	if err != nil {
+		return err
+	}
+	if album == nil {
+		album = &albumMetadata{
+			Version:   metadataVersion,
+			GroupedID: meta.GroupedID,
+			Chat:      meta.Chat,
+			Date:      meta.Date,
+		}
+	}
+
+	replaced := false
+	for i, item := range album.Items {
+		if item.MsgID == meta.MsgID {
+			album.Items[i], replaced = meta, true
+		}
+	}
+	if !replaced {
+		album.Items = append(album.Items, meta)
+	}
+	sort.Slice(album.Items, func(i, j int) bool { return album.Items[i].MsgID < album.Items[j].MsgID })
+
+	album.Text, album.Markdown = "", ""
+	for _, item := range album.Items {
+		if item.Text != "" {
+			album.Text, album.Markdown = item.Text, item.Markdown
+			break
+		}
+	}
+
+	data, err := json.MarshalIndent(album, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode album metadata: %w", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// loadAlbum reads an album.json. A missing file yields nil.
+func loadAlbum(path string) (*albumMetadata, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var album albumMetadata
+	if err := json.Unmarshal(data, &album); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &album, nil
+}
+
+// albumHasItem reports whether the album.json in dir lists the message.
+func albumHasItem(dir string, msgID int) bool {
+	albumMux.Lock()
+	defer albumMux.Unlock()
+	album, err := loadAlbum(filepath.Join(dir, albumMetadataName))
+	if err != nil || album == nil {
+		return false
+	}
+	for _, item := range album.Items {
+		if item.MsgID == msgID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveEntry is a recovered message as found in an output directory: the
+// sidecar of a saved file, an album item or a logged text message.
+type archiveEntry struct {
+	Dir  string // Output directory
+	Path string // Saved file, empty for text messages
+	Meta *messageMetadata
+	Kind string // See messageKind
+}
+
+// deletedAt returns when the message was deleted, or posted if that's unknown.
+func (e archiveEntry) deletedAt() time.Time {
+	if !e.Meta.Deletion.DeletedAt.IsZero() {
+		return e.Meta.Deletion.DeletedAt
+	}
+	return e.Meta.Date
+}
+
+// size returns the size of the saved file, 0 for text messages.
+func (e archiveEntry) size() int64 {
+	if e.Meta.File == nil {
+		return 0
+	}
+	return e.Meta.File.Size
+}
+
+// messageID identifies the message of the entry. Web page previews and
+// other attachments are saved as a second file of the same message.
+func (e archiveEntry) messageID() string {
+	return fmt.Sprintf("%s|%s_%d|%d", e.Dir, e.Meta.Chat.Kind, e.Meta.Chat.ID, e.Meta.MsgID)
+}
+
+// sender returns the readable sender of the message, or "" if unknown.
+func (e archiveEntry) sender() string {
+	if e.Meta.Sender != nil {
+		return e.Meta.Sender.label()
+	}
+	return e.Meta.Author
+}
+
+// deleter returns the user who deleted the message, or nil if unknown.
+func (e archiveEntry) deleter() *peerMeta {
+	if d := e.Meta.Deletion.Deleter; d != nil {
+		return d
+	}
+	if id := e.Meta.Deletion.DeletedBy; id != 0 {
+		return &peerMeta{Kind: kindUser.String(), ID: id}
+	}
+	return nil
+}
+
+// channel returns the readable name of the message's chat.
+func (e archiveEntry) channel() string {
+	chat := e.Meta.Chat
+	switch {
+	case chat.Ref != "":
+		return chat.Ref
+	case chat.Title != "":
+		return chat.Title
+	default:
+		return fmt.Sprintf("%s %d", chat.Kind, chat.ID)
+	}
+}
+
+// fileID identifies the saved file of the entry, or the message of a text
+// entry.
+func (e archiveEntry) fileID() string {
+	return e.messageID() + "|" + filepath.Clean(e.Path)
+}
+
+// loadArchive reads the metadata of everything recovered into dirs, ordered
+// by deletion time: the sidecars, album files and text logs, and the
+// catalogue if there is one, see mergeCatalog. Missing directories are
+// skipped, unreadable files are reported in the error after the rest was
+// read.
+func loadArchive(dirs []string) ([]archiveEntry, error) {
+	var (
+		entries []archiveEntry
+		errs    []error
+	)
+	for _, dir := range dirs {
+		var found []archiveEntry
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == dir && errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			name := d.Name()
+			if d.IsDir() {
+				switch name {
+				case stateDirName, storeDirName, cacheDirName:
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			read, err := readArchiveFile(dir, path, name)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			found = append(found, read...)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", dir, err))
+		}
+		found, err = mergeCatalog(dir, found)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		entries = append(entries, found...)
+	}
+	for i := range entries {
+		if entries[i].Kind != "" {
+			continue // From the catalogue
+		}
+		if msg, err := entries[i].Meta.message(); err == nil {
+			entries[i].Kind = messageKind(msg)
+		} else if entries[i].Meta.File != nil {
+			entries[i].Kind = entries[i].Meta.File.Media
+		} else {
+			entries[i].Kind = "text"
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.deletedAt().Equal(b.deletedAt()) {
+			return a.deletedAt().Before(b.deletedAt())
+		}
+		return a.Meta.MsgID < b.Meta.MsgID
+	})
+	return entries, errors.Join(errs...)
+}
+
+// mergeCatalog adds what the catalogue of dir knows to the entries read from
+// its files: the deleter of messages whose sidecar lacks it, like real-time
+// captures the admin log reported later, the SHA-256 of saved files, and the
+// messages whose sidecar or text log is gone. Without a catalogue, e.g. if
+// -catalog was never used, the entries are returned as they are.
+func mergeCatalog(dir string, entries []archiveEntry) ([]archiveEntry, error) {
+	c, err := openCatalogReadOnly(dir)
+	if err != nil || c == nil {
+		return entries, err
+	}
+	defer c.close() // nolint:errcheck
+	recorded, err := c.archiveEntries()
+
+	known := make(map[string]int, len(entries))
+	for i, e := range entries {
+		known[e.fileID()] = i
+	}
+	for _, r := range recorded {
+		i, ok := known[r.fileID()]
+		if !ok {
+			if r.Path == "" || fileExists(r.Path) { // Not removed by hand
+				entries = append(entries, r)
+			}
+			continue
+		}
+		e := entries[i]
+		if e.Meta.Deletion.DeletedBy == 0 {
+			e.Meta.Deletion.DeletedBy, e.Meta.Deletion.Deleter = r.Meta.Deletion.DeletedBy, r.Meta.Deletion.Deleter
+		}
+		if e.Meta.File != nil && e.Meta.File.SHA256 == "" && r.Meta.File != nil {
+			e.Meta.File.SHA256 = r.Meta.File.SHA256
+		}
+	}
+	return entries, err
+}
+
+// readArchiveFile returns the messages described by one file of an output
+// directory, nothing if it's not a metadata file.
+func readArchiveFile(dir, path, name string) ([]archiveEntry, error) {
+	switch {
+	case name == albumMetadataName:
+		album, err := loadAlbum(path)
+		if err != nil || album == nil {
+			return nil, err
+		}
+		var entries []archiveEntry
+		for _, item := range album.Items {
+			entry := archiveEntry{Dir: dir, Meta: item}
+			if item.File != nil {
+				entry.Path = filepath.Join(filepath.Dir(path), item.File.Name)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	case strings.HasSuffix(name, ".jsonl") && filepath.Base(filepath.Dir(path)) == textLogDirName:
+		return readTextLog(dir, path)
+	case strings.HasSuffix(name, metadataSuffix):
+		// Only sidecars: rendered polls and the like are .json files too.
+		file := strings.TrimSuffix(path, metadataSuffix)
+		if !fileExists(file) {
+			return nil, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var meta messageMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if meta.Version == 0 || meta.MsgID == 0 {
+			return nil, nil // Some other JSON file
+		}
+		return []archiveEntry{{Dir: dir, Path: file, Meta: &meta}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// readTextLog returns the messages of a JSONL text log, see appendDeletedText.
+func readTextLog(dir, path string) ([]archiveEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close() // nolint:errcheck
+
+	var entries []archiveEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024) // Long messages carry their TL encoding
+	for scanner.Scan() {
+		var meta messageMetadata
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			continue // Torn line of an interrupted write
+		}
+		entries = append(entries, archiveEntry{Dir: dir, Meta: &meta})
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return entries, nil
+}
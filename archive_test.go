@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// writeTestArchive lays out an output directory like a backup run does: a
+// photo with its sidecar, an album and a logged text message.
+func writeTestArchive(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	chat := chatMeta{Kind: kindChannel.String(), ID: 100, Title: "News", Ref: "@news"}
+	deletedAt := time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC)
+	newMeta := func(msg *tg.Message, deleter *peerMeta) *messageMetadata {
+		msg.PeerID = &tg.PeerChannel{ChannelID: chat.ID}
+		msg.FromID = &tg.PeerUser{UserID: 111}
+		msg.Date = int(deletedAt.Add(-time.Hour).Unix())
+		meta, err := newMessageMetadata(msg, chat, sourceAdminLog, deletionMeta{DeletedBy: 222, Deleter: deleter, DeletedAt: deletedAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.Sender.Username = "alice"
+		return meta
+	}
+	write := func(path string, data []byte) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod := &peerMeta{Kind: kindUser.String(), ID: 222, Username: "mod"}
+
+	photo := filepath.Join(dir, "@alice (111)", "photo.jpg")
+	write(photo, []byte("jpeg"))
+	meta := newMeta(&tg.Message{ID: 1, Message: "sunset", Media: &tg.MessageMediaPhoto{}}, mod)
+	meta.File = &fileMeta{Name: "photo.jpg", Size: 4, Media: "photo"}
+	if err := writeMetadata(photo, meta); err != nil {
+		t.Fatal(err)
+	}
+	// A rendered poll is JSON too, but not a sidecar.
+	write(filepath.Join(dir, "@alice (111)", "poll.json"), []byte(`{"question":"?"}`))
+
+	video := &tg.MessageMediaDocument{Document: &tg.Document{
+		MimeType:   "video/mp4",
+		Attributes: []tg.DocumentAttributeClass{&tg.DocumentAttributeVideo{}},
+	}}
+	albumDir := filepath.Join(dir, "@alice (111)", albumDirName(5))
+	for _, id := range []int{2, 3} {
+		write(filepath.Join(albumDir, "clip.mp4"), []byte("mp4"))
+		item := newMeta(&tg.Message{ID: id, GroupedID: 5, Media: video}, nil)
+		item.File = &fileMeta{Name: "clip.mp4", Size: 3, Media: "document"}
+		if err := addToAlbum(albumDir, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	text := newMeta(&tg.Message{ID: 4, Message: "hello world"}, mod)
+	line, err := json.Marshal(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(textLogPath(dir, chat)+".jsonl", append(line, '\n'))
+	return dir
+}
+
+func TestLoadArchive(t *testing.T) {
+	dir := writeTestArchive(t)
+	entries, err := loadArchive([]string{dir, filepath.Join(dir, "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Kind+":"+filepath.Base(e.Path))
+	}
+	want := "photo:photo.jpg video:clip.mp4 video:clip.mp4 text:."
+	if strings.Join(got, " ") != want {
+		t.Errorf("loadArchive returned %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestLoadArchiveCatalog(t *testing.T) {
+	dir := writeTestArchive(t)
+	c, err := openCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := chatMeta{Kind: kindChannel.String(), ID: 100, Title: "News"}
+
+	// The photo, recorded with its hash.
+	photo := &tg.Message{ID: 1, PeerID: &tg.PeerChannel{ChannelID: 100}, Media: &tg.MessageMediaPhoto{}}
+	meta, err := newMessageMetadata(photo, chat, sourceAdminLog, deletionMeta{DeletedBy: 222})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &mediaTarget{loc: &tg.InputPhotoFileLocation{ID: 5}, destPath: filepath.Join(dir, "@alice (111)", "photo.jpg")}
+	if err := c.recordFile(target, photo, meta, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A message captured in real time whose text log was lost; the admin
+	// log reported who deleted it.
+	text := &tg.Message{ID: 6, Message: "bye", PeerID: &tg.PeerChannel{ChannelID: 100}, FromID: &tg.PeerUser{UserID: 111}}
+	meta, err = newMessageMetadata(text, chat, sourceRealtime, deletionMeta{DeletedAt: time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.recordMessage(text, meta); err != nil {
+		t.Fatal(err)
+	}
+	ev := tg.ChannelAdminLogEvent{ID: 9, UserID: 333, Action: &tg.ChannelAdminLogEventActionDeleteMessage{Message: text}}
+	if err := c.recordEvent(100, ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadArchive([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%d:%s:%s", e.Meta.MsgID, e.Kind, filepath.Base(e.Path)))
+	}
+	want := "1:photo:photo.jpg 2:video:clip.mp4 3:video:clip.mp4 4:text:. 6:text:."
+	if strings.Join(got, " ") != want {
+		t.Fatalf("loadArchive returned %q, want %q", strings.Join(got, " "), want)
+	}
+	hash, err := fileSHA256(target.destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo := entries[0]; photo.Meta.File.SHA256 != hash || photo.Meta.Text != "sunset" {
+		t.Errorf("photo merged as %+v, want the sidecar with the hash of the catalogue", photo.Meta.File)
+	}
+	if d := entries[4].deleter(); d == nil || d.ID != 333 || entries[4].Meta.Text != "bye" {
+		t.Errorf("message 6 loaded with deleter %+v, text %q", d, entries[4].Meta.Text)
+	}
+}
+
+func TestQueryCommands(t *testing.T) {
+	dir := writeTestArchive(t)
+	run := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if code := runQuery(args[0], append([]string{"-dir", dir}, args[1:]...), &out); code != 0 {
+			t.Fatalf("%v exited with %d", args, code)
+		}
+		return out.String()
+	}
+
+	var stats []statsRow
+	if err := json.Unmarshal([]byte(run("stats", "-by", "type", "-json")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	want := []statsRow{{"video", 2, 2, 6}, {"photo", 1, 1, 4}, {"text", 1, 0, 0}}
+	if len(stats) != len(want) {
+		t.Fatalf("stats -by type = %+v, want %+v", stats, want)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("stats row %d = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+
+	var items []archiveItem
+	if err := json.Unmarshal([]byte(run("list", "-deleter", "@mod", "-json")), &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].MsgID != 1 || items[1].MsgID != 4 {
+		t.Errorf("list -deleter @mod = %+v, want messages 1 and 4", items)
+	}
+
+	if out := run("search", "WORLD"); !strings.Contains(out, "hello world") || strings.Contains(out, "photo.jpg") {
+		t.Errorf("search WORLD printed:\n%s", out)
+	}
+	if out := run("show", "1"); !strings.Contains(out, "by @mod (222)") || !strings.Contains(out, "sunset") {
+		t.Errorf("show 1 printed:\n%s", out)
+	}
+}
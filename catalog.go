@@ -0,0 +1,491 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite" // Pure-Go driver, see catalogDriver
+)
+
+// catalogFileName is the SQLite database inside an output directory listing
+// every processed admin log event and every recovered message and file.
+const catalogFileName = "catalog.db"
+
+// catalogDriver is the database/sql driver of the catalogue, registered by
+// modernc.org/sqlite. It needs no cgo, so the binary stays self-contained.
+const catalogDriver = "sqlite"
+
+// catalogTimeLayout is how times are stored: UTC in SQLite's own format, so
+// its date functions work on them, e.g. deleted_at >= datetime('now', '-7 days').
+const catalogTimeLayout = "2006-01-02 15:04:05"
+
+// File statuses in the catalogue.
+const (
+	fileSaved    = "saved"
+	fileDegraded = "degraded" // Only a preview was saved, see savePreviewFallback
+	fileFailed   = "failed"
+)
+
+// catalogSchema creates the tables of a new catalogue. Paths are relative
+// to the output directory, with forward slashes.
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	channel_id INTEGER NOT NULL,
+	event_id   INTEGER NOT NULL,
+	date       TEXT NOT NULL,
+	user_id    INTEGER NOT NULL, -- Admin who caused the event
+	action     TEXT NOT NULL,    -- delete_message, edit_message, ...
+	msg_id     INTEGER,          -- Message the event is about
+	PRIMARY KEY (channel_id, event_id)
+);
+CREATE TABLE IF NOT EXISTS messages (
+	chat_kind        TEXT NOT NULL,
+	chat_id          INTEGER NOT NULL,
+	msg_id           INTEGER NOT NULL,
+	chat_title       TEXT,
+	date             TEXT NOT NULL,
+	source           TEXT NOT NULL, -- admin_log or realtime
+	type             TEXT NOT NULL, -- Kind as in -kinds
+	text             TEXT,
+	grouped_id       INTEGER,
+	sender_kind      TEXT,
+	sender_id        INTEGER,
+	sender_username  TEXT,
+	sender_name      TEXT,
+	deleted_by       INTEGER,
+	deleter_username TEXT,
+	deleter_name     TEXT,
+	deleted_at       TEXT,
+	event_id         INTEGER,
+	PRIMARY KEY (chat_kind, chat_id, msg_id)
+);
+CREATE INDEX IF NOT EXISTS messages_deleted_by ON messages (deleted_by, deleted_at);
+CREATE INDEX IF NOT EXISTS messages_sender ON messages (sender_id, date);
+CREATE TABLE IF NOT EXISTS files (
+	path       TEXT PRIMARY KEY,
+	chat_kind  TEXT NOT NULL,
+	chat_id    INTEGER NOT NULL,
+	msg_id     INTEGER NOT NULL,
+	file_key   TEXT,             -- Telegram file, see fileKey
+	media      TEXT,
+	mime_type  TEXT,
+	size       INTEGER,
+	sha256     TEXT,
+	status     TEXT NOT NULL,    -- saved, degraded or failed
+	error      TEXT,
+	updated_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_message ON files (chat_kind, chat_id, msg_id);
+CREATE INDEX IF NOT EXISTS files_key ON files (file_key);
+CREATE INDEX IF NOT EXISTS files_sha256 ON files (sha256);
+CREATE TABLE IF NOT EXISTS cursors (
+	channel_id    INTEGER PRIMARY KEY,
+	last_event_id INTEGER NOT NULL,
+	updated_at    TEXT NOT NULL
+);
+`
+
+// catalog is the SQLite catalogue of one output directory.
+type catalog struct {
+	dir string // Output directory
+	db  *sql.DB
+}
+
+// openCatalog opens the catalogue of an output directory, creating it if
+// needed.
+func openCatalog(outputDir string) (*catalog, error) {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	path := filepath.Join(outputDir, catalogFileName)
+	// WAL lets queries read while a backup writes. The busy timeout covers
+	// a concurrent watch process.
+	db, err := sql.Open(catalogDriver, path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	// SQLite allows one writer at a time, downloads wait for each other
+	// here instead of failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(catalogSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create the tables of %s: %w", path, err)
+	}
+	return &catalog{dir: outputDir, db: db}, nil
+}
+
+// openCatalogReadOnly opens the catalogue of an output directory for reading
+// only, or returns nil if there is none. Unlike openCatalog it never creates
+// or changes anything, for dry runs and the query commands.
+func openCatalogReadOnly(outputDir string) (*catalog, error) {
+	path := filepath.Join(outputDir, catalogFileName)
+	if !fileExists(path) {
+		return nil, nil
+	}
+	// A URI, so the path may contain any character.
+	uri := url.URL{Scheme: "file", OmitHost: true, Path: filepath.ToSlash(path), RawQuery: "mode=ro&_pragma=busy_timeout(5000)"}
+	db, err := sql.Open(catalogDriver, uri.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &catalog{dir: outputDir, db: db}, nil
+}
+
+func (c *catalog) close() error {
+	return c.db.Close()
+}
+
+// catalogFor returns the catalogue of an output directory, or nil if the
+// catalogue is off or can't be opened.
+func (f *fetcher) catalogFor(outputDir string) *catalog {
+	if !f.catalog || outputDir == "" {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if c, ok := f.catalogs[outputDir]; ok {
+		return c
+	}
+	c, err := openCatalog(outputDir)
+	if err != nil {
+		f.log.Warn("Failed to open catalogue, nothing is recorded", zap.String("output_dir", outputDir), zap.Error(err))
+	}
+	f.catalogs[outputDir] = c // nil if it failed, so it's only reported once
+	return c
+}
+
+// closeCatalogs closes the catalogue of every output directory.
+func (f *fetcher) closeCatalogs() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for outputDir, c := range f.catalogs {
+		if c == nil {
+			continue
+		}
+		if err := c.close(); err != nil {
+			f.log.Warn("Failed to close catalogue", zap.String("output_dir", outputDir), zap.Error(err))
+		}
+	}
+	f.catalogs = make(map[string]*catalog)
+}
+
+func catalogTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(catalogTimeLayout)
+}
+
+// nullIf stores v as NULL if it's the zero value, e.g. an unknown deleter.
+func nullIf[T comparable](v T) any {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
+}
+
+// recordEvent records a processed admin log event.
+func (c *catalog) recordEvent(channelID int64, ev tg.ChannelAdminLogEvent) error {
+	if c == nil {
+		return nil
+	}
+	var msgID any
+	switch action := ev.Action.(type) {
+	case *tg.ChannelAdminLogEventActionDeleteMessage:
+		msgID = action.Message.GetID()
+	case *tg.ChannelAdminLogEventActionEditMessage:
+		msgID = action.NewMessage.GetID()
+	case *tg.ChannelAdminLogEventActionUpdatePinned:
+		msgID = action.Message.GetID()
+	}
+	action := snakeCase(strings.TrimPrefix(ev.Action.TypeName(), "channelAdminLogEventAction"))
+	_, err := c.db.Exec(`INSERT OR IGNORE INTO events (channel_id, event_id, date, user_id, action, msg_id) VALUES (?, ?, ?, ?, ?, ?)`,
+		channelID, ev.ID, catalogTime(unixTime(ev.Date)), ev.UserID, action, msgID)
+	if err != nil {
+		return fmt.Errorf("failed to record admin log event %d: %w", ev.ID, err)
+	}
+	return nil
+}
+
+// recordMessage records a deleted message. Names and the deleter already
+// known are kept if meta doesn't have them, e.g. when real-time capture
+// saves a message the admin log recorded before.
+func (c *catalog) recordMessage(msg *tg.Message, meta *messageMetadata) error {
+	if c == nil || meta == nil {
+		return nil
+	}
+	var senderKind, senderUsername, senderName any
+	var senderID any
+	if s := meta.Sender; s != nil {
+		senderKind, senderID, senderUsername, senderName = s.Kind, s.ID, nullIf(s.Username), nullIf(s.Name)
+	}
+	var deleterUsername, deleterName any
+	if d := meta.Deletion.Deleter; d != nil {
+		deleterUsername, deleterName = nullIf(d.Username), nullIf(d.Name)
+	}
+	_, err := c.db.Exec(`
+INSERT INTO messages (chat_kind, chat_id, msg_id, chat_title, date, source, type, text, grouped_id,
+	sender_kind, sender_id, sender_username, sender_name,
+	deleted_by, deleter_username, deleter_name, deleted_at, event_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (chat_kind, chat_id, msg_id) DO UPDATE SET
+	chat_title = coalesce(excluded.chat_title, chat_title),
+	type = excluded.type,
+	text = excluded.text,
+	sender_username = coalesce(excluded.sender_username, sender_username),
+	sender_name = coalesce(excluded.sender_name, sender_name),
+	deleted_by = coalesce(excluded.deleted_by, deleted_by),
+	deleter_username = coalesce(excluded.deleter_username, deleter_username),
+	deleter_name = coalesce(excluded.deleter_name, deleter_name),
+	deleted_at = coalesce(deleted_at, excluded.deleted_at),
+	event_id = coalesce(excluded.event_id, event_id)`,
+		meta.Chat.Kind, meta.Chat.ID, meta.MsgID, nullIf(meta.Chat.Title), catalogTime(meta.Date), meta.Source,
+		messageKind(msg), nullIf(meta.Text), nullIf(meta.GroupedID),
+		senderKind, senderID, senderUsername, senderName,
+		nullIf(meta.Deletion.DeletedBy), deleterUsername, deleterName, catalogTime(meta.Deletion.DeletedAt), nullIf(meta.Deletion.EventID))
+	if err != nil {
+		return fmt.Errorf("failed to record message %d: %w", meta.MsgID, err)
+	}
+	return nil
+}
+
+// recordFile records the outcome of saving t: saved, saved as a preview, or
+// failed with saveErr. The SHA-256 of a saved file is computed unless the
+// content store already did, or the file is recorded with the same size.
+func (c *catalog) recordFile(t *mediaTarget, msg *tg.Message, meta *messageMetadata, saveErr error) error {
+	if c == nil || meta == nil || (saveErr != nil && failureReasonOf(saveErr) == reasonCanceled) {
+		return nil
+	}
+	if err := c.recordMessage(msg, meta); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(c.dir, t.destPath)
+	if err != nil {
+		return fmt.Errorf("failed to record %s: %w", t.destPath, err)
+	}
+	rel = filepath.ToSlash(rel)
+
+	file := mediaFileMeta(msg, t.destPath)
+	status, errText, hash := fileSaved, "", t.sha256
+	var size any
+	switch {
+	case saveErr != nil:
+		status, errText = fileFailed, saveErr.Error()
+	case t.fallback != "":
+		status, errText = fileDegraded, t.fallbackErr
+		file.MimeType = "image/jpeg"
+	}
+	if saveErr == nil {
+		info, err := os.Stat(t.destPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", t.destPath, err)
+		}
+		size = info.Size()
+		if hash == "" {
+			var known string
+			err := c.db.QueryRow(`SELECT sha256 FROM files WHERE path = ? AND size = ? AND sha256 IS NOT NULL`, rel, info.Size()).Scan(&known)
+			if err == nil {
+				hash = known
+			} else if hash, err = fileSHA256(t.destPath); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = c.db.Exec(`
+INSERT INTO files (path, chat_kind, chat_id, msg_id, file_key, media, mime_type, size, sha256, status, error, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (path) DO UPDATE SET
+	file_key = excluded.file_key,
+	media = excluded.media,
+	mime_type = excluded.mime_type,
+	size = excluded.size,
+	sha256 = excluded.sha256,
+	status = excluded.status,
+	error = excluded.error,
+	updated_at = excluded.updated_at`,
+		rel, meta.Chat.Kind, meta.Chat.ID, meta.MsgID, nullIf(fileKey(t.loc)), nullIf(file.Media), nullIf(file.MimeType),
+		size, nullIf(hash), status, nullIf(errText), catalogTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to record %s: %w", rel, err)
+	}
+	return nil
+}
+
+// archiveEntries returns the recorded messages for the query commands: one
+// entry per saved file, and one per text message. The deleter of messages
+// that lack one, e.g. real-time captures, is taken from the admin log events.
+func (c *catalog) archiveEntries() ([]archiveEntry, error) {
+	rows, err := c.db.Query(`
+SELECT m.chat_kind, m.chat_id, m.msg_id, m.chat_title, m.date, m.source, m.type, m.text, m.grouped_id,
+	m.sender_kind, m.sender_id, m.sender_username, m.sender_name,
+	coalesce(m.deleted_by, e.user_id), m.deleter_username, m.deleter_name, coalesce(m.deleted_at, e.date), coalesce(m.event_id, e.event_id),
+	f.path, f.media, f.mime_type, f.size, f.sha256, f.status
+FROM messages m
+LEFT JOIN events e ON m.chat_kind = 'channel' AND e.channel_id = m.chat_id AND e.msg_id = m.msg_id AND e.action = 'delete_message'
+LEFT JOIN files f ON f.chat_kind = m.chat_kind AND f.chat_id = m.chat_id AND f.msg_id = m.msg_id AND f.status != 'failed'
+WHERE f.path IS NOT NULL OR m.type = 'text'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages of %s: %w", c.dir, err)
+	}
+	defer rows.Close() // nolint:errcheck
+
+	var entries []archiveEntry
+	for rows.Next() {
+		var (
+			meta                                                  = &messageMetadata{Version: metadataVersion}
+			title, date, text, senderKind, senderUser, senderName sql.NullString
+			deleterUser, deleterName, deletedAt                   sql.NullString
+			path, media, mimeType, hash, status                   sql.NullString
+			groupedID, senderID, deletedBy, eventID, size         sql.NullInt64
+			kind                                                  string
+		)
+		if err := rows.Scan(&meta.Chat.Kind, &meta.Chat.ID, &meta.MsgID, &title, &date, &meta.Source, &kind, &text, &groupedID,
+			&senderKind, &senderID, &senderUser, &senderName,
+			&deletedBy, &deleterUser, &deleterName, &deletedAt, &eventID,
+			&path, &media, &mimeType, &size, &hash, &status); err != nil {
+			return entries, fmt.Errorf("failed to read messages of %s: %w", c.dir, err)
+		}
+		meta.Chat.Title, meta.Text, meta.GroupedID = title.String, text.String, groupedID.Int64
+		meta.Date, meta.Deletion.DeletedAt = parseCatalogTime(date.String), parseCatalogTime(deletedAt.String)
+		meta.Deletion.DeletedBy, meta.Deletion.EventID = deletedBy.Int64, eventID.Int64
+		if senderKind.Valid {
+			meta.Sender = &peerMeta{Kind: senderKind.String, ID: senderID.Int64, Username: senderUser.String, Name: senderName.String}
+		}
+		if deletedBy.Int64 != 0 {
+			meta.Deletion.Deleter = &peerMeta{Kind: kindUser.String(), ID: deletedBy.Int64, Username: deleterUser.String, Name: deleterName.String}
+		}
+		entry := archiveEntry{Dir: c.dir, Meta: meta, Kind: kind}
+		if path.Valid {
+			entry.Path = filepath.Join(c.dir, filepath.FromSlash(path.String))
+			meta.File = &fileMeta{
+				Name:     filepath.Base(entry.Path),
+				Size:     size.Int64,
+				Media:    media.String,
+				MimeType: mimeType.String,
+				SHA256:   hash.String,
+				Degraded: status.String == fileDegraded,
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read messages of %s: %w", c.dir, err)
+	}
+	return entries, nil
+}
+
+// parseCatalogTime parses a time as stored by catalogTime, the zero time if
+// it's empty or invalid.
+func parseCatalogTime(s string) time.Time {
+	t, err := time.ParseInLocation(catalogTimeLayout, s, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// savedCopy returns a saved file of the Telegram file key other than dest,
+// or "" if there is none on disk.
+func (c *catalog) savedCopy(key, dest string) string {
+	if c == nil || key == "" {
+		return ""
+	}
+	rows, err := c.db.Query(`SELECT path FROM files WHERE file_key = ? AND status = 'saved'`, key)
+	if err != nil {
+		return ""
+	}
+	defer rows.Close() // nolint:errcheck
+	for rows.Next() {
+		var rel string
+		if rows.Scan(&rel) != nil {
+			continue
+		}
+		path := filepath.Join(c.dir, filepath.FromSlash(rel))
+		if path != dest && fileExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// saveCursor records the admin log cursor of a channel next to the state
+// file, see cursor.
+func (c *catalog) saveCursor(channelID, eventID int64) error {
+	if c == nil {
+		return nil
+	}
+	_, err := c.db.Exec(`INSERT INTO cursors (channel_id, last_event_id, updated_at) VALUES (?, ?, ?)
+ON CONFLICT (channel_id) DO UPDATE SET last_event_id = excluded.last_event_id, updated_at = excluded.updated_at`,
+		channelID, eventID, catalogTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to record cursor of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+// cursor returns the recorded admin log cursor of a channel, 0 if there is
+// none. It restores the cursor if the state directory was lost.
+func (c *catalog) cursor(channelID int64) (int64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	var id int64
+	err := c.db.QueryRow(`SELECT last_event_id FROM cursors WHERE channel_id = ?`, channelID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cursor of channel %d: %w", channelID, err)
+	}
+	return id, nil
+}
+
+// copySaved copies src, a saved copy of the same Telegram file, to path
+// instead of downloading it again. Like a download, the copy only appears
+// under its final name once it's complete.
+func (f *fetcher) copySaved(src, path string) error {
+	unlock := f.lockPath(path)
+	defer unlock()
+	if fileExists(path) {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close() // nolint:errcheck
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to copy %s to %s: %w", src, path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func openTestCatalog(t *testing.T) *catalog {
+	t.Helper()
+	c, err := openCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.close() })
+	return c
+}
+
+func TestCatalogRecordEvent(t *testing.T) {
+	c := openTestCatalog(t)
+	ev := tg.ChannelAdminLogEvent{
+		ID:     42,
+		Date:   int(time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC).Unix()),
+		UserID: 222,
+		Action: &tg.ChannelAdminLogEventActionDeleteMessage{Message: &tg.Message{ID: 7}},
+	}
+	for range 2 { // Walking the log again doesn't duplicate events
+		if err := c.recordEvent(100, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		count         int
+		date, action  string
+		userID, msgID int64
+	)
+	if err := c.db.QueryRow(`SELECT count(*), date, user_id, action, msg_id FROM events WHERE channel_id = 100`).
+		Scan(&count, &date, &userID, &action, &msgID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || date != "2024-05-02 08:00:00" || userID != 222 || action != "delete_message" || msgID != 7 {
+		t.Errorf("event recorded as %d, %q, %d, %q, %d", count, date, userID, action, msgID)
+	}
+}
+
+func TestCatalogRecordMessage(t *testing.T) {
+	c := openTestCatalog(t)
+	chat := chatMeta{Kind: kindChannel.String(), ID: 100, Title: "News"}
+	msg := &tg.Message{ID: 7, Message: "hello", PeerID: &tg.PeerChannel{ChannelID: 100}, FromID: &tg.PeerUser{UserID: 111}, Date: 1714636800}
+	deletedAt := time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC)
+	meta, err := newMessageMetadata(msg, chat, sourceAdminLog, deletionMeta{
+		DeletedBy: 222,
+		Deleter:   &peerMeta{Kind: kindUser.String(), ID: 222, Username: "mod"},
+		DeletedAt: deletedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.recordMessage(msg, meta); err != nil {
+		t.Fatal(err)
+	}
+	// Real-time capture saving the same message later knows neither the
+	// deleter nor its names, they are kept.
+	later, err := newMessageMetadata(msg, chat, sourceRealtime, deletionMeta{DeletedAt: deletedAt.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.recordMessage(msg, later); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		kind, text, deleter, deletedAtText string
+		senderID, deletedBy                int64
+	)
+	if err := c.db.QueryRow(`SELECT type, text, sender_id, deleted_by, deleter_username, deleted_at FROM messages WHERE chat_id = 100 AND msg_id = 7`).
+		Scan(&kind, &text, &senderID, &deletedBy, &deleter, &deletedAtText); err != nil {
+		t.Fatal(err)
+	}
+	if kind != "text" || text != "hello" || senderID != 111 || deletedBy != 222 || deleter != "mod" || deletedAtText != "2024-05-02 08:00:00" {
+		t.Errorf("message recorded as %q, %q, %d, %d, %q, %q", kind, text, senderID, deletedBy, deleter, deletedAtText)
+	}
+}
+
+func TestCatalogRecordFile(t *testing.T) {
+	c := openTestCatalog(t)
+	chat := chatMeta{Kind: kindChannel.String(), ID: 100}
+	msg := &tg.Message{ID: 7, PeerID: &tg.PeerChannel{ChannelID: 100}, Media: &tg.MessageMediaPhoto{}}
+	meta, err := newMessageMetadata(msg, chat, sourceAdminLog, deletionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := &tg.InputPhotoFileLocation{ID: 5, ThumbSize: "y"}
+
+	failed := &mediaTarget{loc: loc, destPath: filepath.Join(c.dir, "a", "7.jpg")}
+	if err := c.recordFile(failed, msg, meta, errors.New("FILE_REFERENCE_EXPIRED")); err != nil {
+		t.Fatal(err)
+	}
+	var status, errText string
+	if err := c.db.QueryRow(`SELECT status, error FROM files WHERE path = 'a/7.jpg'`).Scan(&status, &errText); err != nil {
+		t.Fatal(err)
+	}
+	if status != fileFailed || errText != "FILE_REFERENCE_EXPIRED" {
+		t.Errorf("failed file recorded as %q, %q", status, errText)
+	}
+
+	// Saved on the next run: the row is updated.
+	if err := os.MkdirAll(filepath.Dir(failed.destPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(failed.destPath, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.recordFile(failed, msg, meta, nil); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		size   int64
+		hash   string
+		errMsg sql.NullString
+	)
+	if err := c.db.QueryRow(`SELECT status, size, sha256, error FROM files WHERE path = 'a/7.jpg'`).Scan(&status, &size, &hash, &errMsg); err != nil {
+		t.Fatal(err)
+	}
+	want, err := fileSHA256(failed.destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != fileSaved || size != 4 || hash != want || errMsg.Valid {
+		t.Errorf("saved file recorded as %q, %d, %q, %v", status, size, hash, errMsg)
+	}
+
+	// Another message with the same photo finds the saved copy.
+	other := filepath.Join(c.dir, "b", "8.jpg")
+	if got := c.savedCopy(fileKey(loc), other); got != failed.destPath {
+		t.Errorf("savedCopy = %q, want %q", got, failed.destPath)
+	}
+	if got := c.savedCopy(fileKey(loc), failed.destPath); got != "" {
+		t.Errorf("savedCopy of the file itself = %q, want none", got)
+	}
+
+	// Canceled downloads aren't failures.
+	canceled := &mediaTarget{loc: loc, destPath: other}
+	if err := c.recordFile(canceled, msg, meta, fmt.Errorf("failed to download: %w", context.Canceled)); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := c.db.QueryRow(`SELECT count(*) FROM files`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d files recorded, want 1", count)
+	}
+}
+
+func TestCatalogCursor(t *testing.T) {
+	c := openTestCatalog(t)
+	if id, err := c.cursor(100); err != nil || id != 0 {
+		t.Fatalf("cursor of a new catalogue = %d, %v", id, err)
+	}
+	for _, id := range []int64{10, 25} {
+		if err := c.saveCursor(100, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id, err := c.cursor(100); err != nil || id != 25 {
+		t.Errorf("cursor = %d, %v, want 25", id, err)
+	}
+	if id, err := c.cursor(200); err != nil || id != 0 {
+		t.Errorf("cursor of another channel = %d, %v, want 0", id, err)
+	}
+
+	// Reopened, as by the next run.
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openCatalog(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close() // nolint:errcheck
+	if id, err := c.cursor(100); err != nil || id != 25 {
+		t.Errorf("cursor after reopening = %d, %v, want 25", id, err)
+	}
+
+	// A nil catalogue, with -catalog off, has no cursor.
+	var off *catalog
+	if id, err := off.cursor(100); err != nil || id != 0 {
+		t.Errorf("cursor without catalogue = %d, %v", id, err)
+	}
+}
+
+func TestLoadCursor(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "News #1") // Needs escaping in the URI
+	c, err := openCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveCursor(100, 25); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run reads the catalogue without changing it.
+	ro, err := openCatalogReadOnly(dir)
+	if err != nil || ro == nil {
+		t.Fatalf("openCatalogReadOnly = %v, %v", ro, err)
+	}
+	defer ro.close() // nolint:errcheck
+	if err := ro.saveCursor(100, 30); err == nil {
+		t.Error("read-only catalogue accepted a write")
+	}
+
+	path := statePath(dir, 100)
+	if st, err := loadCursor(path, 100, ro, zap.NewNop()); err != nil || st.LastEventID != 25 {
+		t.Errorf("cursor without state file = %+v, %v, want 25 from the catalogue", st, err)
+	}
+	if err := saveState(path, channelState{ChannelID: 100, LastEventID: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := loadCursor(path, 100, ro, zap.NewNop()); err != nil || st.LastEventID != 40 {
+		t.Errorf("cursor with state file = %+v, %v, want 40", st, err)
+	}
+	if st, err := loadCursor(statePath(dir, 200), 200, nil, zap.NewNop()); err != nil || st.LastEventID != 0 {
+		t.Errorf("cursor of a new channel = %+v, %v", st, err)
+	}
+
+	if c, err := openCatalogReadOnly(t.TempDir()); c != nil || err != nil {
+		t.Errorf("openCatalogReadOnly without catalogue = %v, %v, want none", c, err)
+	}
+}
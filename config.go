@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultMediaDir is where media is stored when a channel has no output_dir.
+const defaultMediaDir = "media_backup"
+
+// Config describes every channel processed in a single run.
+type Config struct {
+	Channels []ChannelConfig `json:"channels"`
+}
+
+// ChannelConfig holds the per-channel settings from the config file.
+type ChannelConfig struct {
+	Channel   string        `json:"channel"`    // @username, t.me link, -100 prefixed or bare ID
+	ID        int64         `json:"id"`         // Numeric channel ID, kept for older config files
+	OutputDir string        `json:"output_dir"` // Optional, defaults to media_backup
+	Interval  string        `json:"interval"`   // Optional watch mode poll interval, e.g. "30s" or "5m"
+	Filter    *FilterConfig `json:"filter"`     // Optional, applies on top of the command line filter
+
+	PathTemplate string `json:"path_template"` // Optional layout of saved files, overrides -path-template
+
+	ref      peerRef        // Parsed form of Channel/ID
+	interval time.Duration  // Parsed form of Interval, 0 means the -interval default
+	filter   *messageFilter // Parsed form of Filter
+	layout   *pathTemplate  // Parsed form of PathTemplate
+}
+
+// loadConfig builds the run configuration.
+// If CONFIG_FILE is set the channel list is read from that JSON file,
+// otherwise a single channel is taken from CHANNEL_ID (the original behaviour).
+func loadConfig() (*Config, error) {
+	var cfg Config
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if len(cfg.Channels) == 0 {
+			return nil, fmt.Errorf("config file %s does not list any channels", path)
+		}
+	} else {
+		channel := os.Getenv("CHANNEL_ID")
+		if channel == "" {
+			return nil, errors.New("CHANNEL_ID not found in environment variables or .env file, and CONFIG_FILE is not set. Please set one of them")
+		}
+		cfg.Channels = []ChannelConfig{{Channel: channel}}
+	}
+
+	seen := make(map[string]bool, len(cfg.Channels))
+	for i := range cfg.Channels {
+		ch := &cfg.Channels[i]
+		channel := ch.Channel
+		if channel == "" && ch.ID != 0 {
+			channel = strconv.FormatInt(ch.ID, 10)
+		}
+		if channel == "" {
+			return nil, fmt.Errorf("channel #%d in config has neither channel nor id", i+1)
+		}
+		ref, err := parsePeerRef(channel)
+		if err != nil {
+			return nil, fmt.Errorf("channel #%d in config: %w", i+1, err)
+		}
+		ch.ref = ref
+		if seen[ref.String()] {
+			return nil, fmt.Errorf("channel %s is listed more than once in config", ref)
+		}
+		seen[ref.String()] = true
+		if ch.OutputDir == "" {
+			ch.OutputDir = defaultMediaDir
+		}
+		if ch.Interval != "" {
+			interval, err := time.ParseDuration(ch.Interval)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("channel %s has invalid interval %q (use e.g. \"30s\" or \"5m\")", ref, ch.Interval)
+			}
+			ch.interval = interval
+		}
+		if ch.PathTemplate != "" {
+			if ch.layout, err = parsePathTemplate(ch.PathTemplate); err != nil {
+				return nil, fmt.Errorf("channel %s: %w", ref, err)
+			}
+		}
+		if ch.Filter != nil {
+			if ch.filter, err = ch.Filter.parse(); err != nil {
+				return nil, fmt.Errorf("channel %s has an invalid filter: %w", ref, err)
+			}
+		}
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// storeDirName is the content store inside an output directory. Every
+// downloaded file is kept there once, named after its SHA-256, and linked
+// from the places it was posted to.
+const storeDirName = ".store"
+
+// linkMode selects how saved files point into the content store.
+type linkMode int
+
+const (
+	linkNone    linkMode = iota // No deduplication
+	linkHard                    // Hard links, files look like regular copies
+	linkSymlink                 // Relative symbolic links, also work across file systems
+)
+
+// parseLinkMode parses the value of -dedup.
+func parseLinkMode(s string) (linkMode, error) {
+	switch s {
+	case "", "off":
+		return linkNone, nil
+	case "hardlink":
+		return linkHard, nil
+	case "symlink":
+		return linkSymlink, nil
+	default:
+		return linkNone, fmt.Errorf("unknown mode %q, use hardlink, symlink or off", s)
+	}
+}
+
+// storeIndex is the persisted index of a content store.
+type storeIndex struct {
+	Files      map[string]string `json:"files"`       // Telegram file key -> SHA-256
+	Blobs      map[string]string `json:"blobs"`       // SHA-256 -> blob path relative to the store
+	Links      int               `json:"links"`       // Duplicates linked instead of stored again
+	BytesSaved int64             `json:"bytes_saved"` // Their total size
+}
+
+// storeSaveEvery is how many index changes are batched before the index is
+// written. The rest is written by fetcher.closeStores at the end of a run.
+const storeSaveEvery = 50
+
+// hardLink creates hard links, a variable so tests can make it fail like it
+// does across file systems.
+var hardLink = os.Link
+
+// contentStore deduplicates the downloads of one output directory.
+type contentStore struct {
+	dir  string
+	mode linkMode
+
+	mux        sync.Mutex
+	index      storeIndex
+	unsaved    int   // Index changes not written yet
+	links      int   // Duplicates in this run
+	bytesSaved int64 // Their total size
+}
+
+// contentStoreFor returns the store of an output directory, or nil if
+// deduplication is off or the store can't be opened.
+func (f *fetcher) contentStoreFor(outputDir string) *contentStore {
+	if f.dedup == linkNone || outputDir == "" {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if s, ok := f.stores[outputDir]; ok {
+		return s
+	}
+	s := &contentStore{dir: filepath.Join(outputDir, storeDirName), mode: f.dedup}
+	if err := s.load(); err != nil {
+		f.log.Warn("Failed to open content store, files are saved without deduplication", zap.Error(err))
+		return nil
+	}
+	f.stores[outputDir] = s
+	return s
+}
+
+func (s *contentStore) indexPath() string {
+	return filepath.Join(s.dir, "index.json")
+}
+
+func (s *contentStore) load() error {
+	s.index = storeIndex{Files: make(map[string]string), Blobs: make(map[string]string)}
+	data, err := os.ReadFile(s.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.indexPath(), err)
+	}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.indexPath(), err)
+	}
+	if s.index.Files == nil {
+		s.index.Files = make(map[string]string)
+	}
+	if s.index.Blobs == nil {
+		s.index.Blobs = make(map[string]string)
+	}
+	return nil
+}
+
+// save writes the index. The caller holds s.mux.
+func (s *contentStore) save() error {
+	s.unsaved = 0
+	data, err := json.MarshalIndent(s.index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode store index: %w", err)
+	}
+	return writeFileAtomic(s.indexPath(), data)
+}
+
+// changed records an index change and writes the index once enough changes
+// were batched. The caller holds s.mux.
+func (s *contentStore) changed() error {
+	s.unsaved++
+	if s.unsaved < storeSaveEvery {
+		return nil
+	}
+	return s.save()
+}
+
+// fileKey identifies the Telegram file behind loc, so a file posted again
+// is found in the store without downloading it. It is empty for other kinds
+// of locations.
+func fileKey(loc tg.InputFileLocationClass) string {
+	switch l := loc.(type) {
+	case *tg.InputDocumentFileLocation:
+		return fmt.Sprintf("document_%d", l.ID)
+	case *tg.InputPhotoFileLocation:
+		return fmt.Sprintf("photo_%d_%s", l.ID, l.ThumbSize)
+	default:
+		return ""
+	}
+}
+
+// blob returns the stored file with the given hash, if it still exists.
+// The caller holds s.mux.
+func (s *contentStore) blob(hash string) (string, bool) {
+	rel, ok := s.index.Blobs[hash]
+	if !ok {
+		return "", false
+	}
+	path := filepath.Join(s.dir, rel)
+	return path, fileExists(path)
+}
+
+// reuse links dest to the stored copy of the Telegram file key, if there is
+// one. It returns the SHA-256 of the file and whether it was linked.
+func (s *contentStore) reuse(key, dest string) (string, bool, error) {
+	if key == "" {
+		return "", false, nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	hash, ok := s.index.Files[key]
+	if !ok {
+		return "", false, nil
+	}
+	blob, ok := s.blob(hash)
+	if !ok {
+		return "", false, nil
+	}
+	if err := s.link(blob, dest); err != nil {
+		return "", false, err
+	}
+	return hash, true, s.count(blob)
+}
+
+// add moves the downloaded file at path into the store and links it back.
+// If the store already holds the same content, the download is replaced by
+// a link to it. path keeps the complete file if linking fails. It returns
+// the SHA-256 of the file.
+func (s *contentStore) add(key, path string) (string, error) {
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if blob, ok := s.blob(hash); ok {
+		if sameFile(blob, path) {
+			return hash, nil // Already linked, e.g. by a concurrent save
+		}
+		if err := s.link(blob, path); err != nil {
+			return "", err
+		}
+		if key != "" {
+			s.index.Files[key] = hash
+		}
+		return hash, s.count(blob)
+	}
+
+	rel := filepath.Join(hash[:2], hash+filepath.Ext(path))
+	blob := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create store directory: %w", err)
+	}
+	if err := os.Rename(path, blob); err != nil {
+		return "", fmt.Errorf("failed to move %s into the store: %w", path, err)
+	}
+	if err := s.link(blob, path); err != nil {
+		if renameErr := os.Rename(blob, path); renameErr != nil {
+			return "", errors.Join(err, fmt.Errorf("failed to move %s back out of the store: %w", path, renameErr))
+		}
+		return "", err
+	}
+	s.index.Blobs[hash] = rel
+	if key != "" {
+		s.index.Files[key] = hash
+	}
+	return hash, s.changed()
+}
+
+// link makes dest point to blob. The link is created next to dest and
+// renamed over it, so an existing dest is only replaced once the link
+// exists. A hard link that fails, e.g. because the output directory spans
+// file systems, falls back to a symbolic link.
+func (s *contentStore) link(blob, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+	}
+	tmp := dest + ".link"
+	_ = os.Remove(tmp) // Left behind by an interrupted run
+	linked := false
+	if s.mode == linkHard {
+		linked = hardLink(blob, tmp) == nil
+	}
+	if !linked {
+		target, err := filepath.Rel(filepath.Dir(dest), blob)
+		if err != nil {
+			target = blob
+		}
+		if err := os.Symlink(target, tmp); err != nil {
+			return fmt.Errorf("failed to link %s to the store: %w", dest, err)
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s with a link to the store: %w", dest, err)
+	}
+	return nil
+}
+
+// count records a duplicate of blob. The caller holds s.mux.
+func (s *contentStore) count(blob string) error {
+	info, err := os.Stat(blob)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", blob, err)
+	}
+	s.links++
+	s.bytesSaved += info.Size()
+	s.index.Links++
+	s.index.BytesSaved += info.Size()
+	return s.changed()
+}
+
+// sameFile reports whether a and b, following symbolic links, are the same file.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	return err == nil && os.SameFile(infoA, infoB)
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close() // nolint:errcheck
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// closeStores writes the index of every content store and logs how much
+// space deduplication saved in each output directory, in this run and
+// overall.
+func (f *fetcher) closeStores() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for outputDir, s := range f.stores {
+		s.mux.Lock()
+		if err := s.save(); err != nil {
+			f.log.Warn("Failed to save content store index", zap.String("output_dir", outputDir), zap.Error(err))
+		}
+		f.log.Info("Deduplication report",
+			zap.String("output_dir", outputDir),
+			zap.Int("duplicates", s.links),
+			zap.String("saved", formatSize(s.bytesSaved)),
+			zap.Int("duplicates_total", s.index.Links),
+			zap.String("saved_total", formatSize(s.index.BytesSaved)),
+			zap.Int("stored_files", len(s.index.Blobs)),
+		)
+		s.mux.Unlock()
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestStore returns an empty content store in a temporary output
+// directory, which is returned too.
+func newTestStore(t *testing.T, mode linkMode) (*contentStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s := &contentStore{dir: filepath.Join(dir, storeDirName), mode: mode}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+// writeTestFile writes a download to dir/name.
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestContentStoreAdd(t *testing.T) {
+	s, dir := newTestStore(t, linkHard)
+	first := writeTestFile(t, dir, "a/1.jpg", "jpeg")
+	hash, err := s.add("photo_1_y", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := fileSHA256(first)
+	if err != nil || hash != want {
+		t.Fatalf("add = %q, want %q (%v)", hash, want, err)
+	}
+	blob := filepath.Join(s.dir, hash[:2], hash+".jpg")
+	if !sameFile(first, blob) {
+		t.Fatal("download isn't linked to the stored copy")
+	}
+	if info, err := os.Lstat(first); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("download is %v, %v, want a hard link", info, err)
+	}
+
+	// The same content under another Telegram file is linked, not stored
+	// again.
+	second := writeTestFile(t, dir, "b/2.jpg", "jpeg")
+	if _, err := s.add("document_2", second); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(second, blob) {
+		t.Error("duplicate isn't linked to the stored copy")
+	}
+	// Adding a file that is already linked changes nothing.
+	if _, err := s.add("document_2", second); err != nil {
+		t.Fatal(err)
+	}
+	if s.links != 1 || s.bytesSaved != 4 || len(s.index.Blobs) != 1 || s.index.Files["document_2"] != hash {
+		t.Errorf("store after duplicates: %d links, %d bytes saved, %d blobs, files %v", s.links, s.bytesSaved, len(s.index.Blobs), s.index.Files)
+	}
+
+	other := writeTestFile(t, dir, "a/3.jpg", "other")
+	if h, err := s.add("", other); err != nil || h == hash {
+		t.Errorf("add of other content = %q, %v", h, err)
+	}
+	if sameFile(other, blob) || len(s.index.Blobs) != 2 {
+		t.Error("different content linked to the same copy")
+	}
+}
+
+func TestContentStoreReuse(t *testing.T) {
+	s, dir := newTestStore(t, linkHard)
+	saved := writeTestFile(t, dir, "a/1.mp4", "mp4")
+	hash, err := s.add("document_1", saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Posted again: linked without downloading.
+	dest := filepath.Join(dir, "b", "2.mp4")
+	if h, ok, err := s.reuse("document_1", dest); err != nil || !ok || h != hash {
+		t.Fatalf("reuse = %q, %v, %v, want %q", h, ok, err, hash)
+	}
+	if !sameFile(dest, saved) {
+		t.Error("reused file isn't linked to the stored copy")
+	}
+	if s.links != 1 || s.bytesSaved != 3 {
+		t.Errorf("%d links, %d bytes saved after reuse", s.links, s.bytesSaved)
+	}
+
+	for _, key := range []string{"", "document_9"} {
+		if _, ok, err := s.reuse(key, filepath.Join(dir, "c.mp4")); ok || err != nil {
+			t.Errorf("reuse(%q) = %v, %v, want nothing to reuse", key, ok, err)
+		}
+	}
+	// A stored copy removed by hand is downloaded again.
+	if err := os.Remove(filepath.Join(s.dir, s.index.Blobs[hash])); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.reuse("document_1", filepath.Join(dir, "c.mp4")); ok || err != nil {
+		t.Errorf("reuse of a removed copy = %v, %v", ok, err)
+	}
+}
+
+func TestContentStoreSymlinks(t *testing.T) {
+	// A hard link fails across file systems.
+	defer func(link func(string, string) error) { hardLink = link }(hardLink)
+	hardLink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("invalid cross-device link")}
+	}
+
+	for _, tt := range []struct {
+		name string
+		mode linkMode
+	}{{"hardlink", linkHard}, {"symlink", linkSymlink}} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestStore(t, tt.mode)
+			path := writeTestFile(t, dir, "a/1.ogg", "ogg")
+			hash, err := s.add("document_1", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				t.Fatalf("download isn't a symbolic link: %v", err)
+			}
+			// Relative, so the output directory can be moved.
+			if want := filepath.Join("..", storeDirName, hash[:2], hash+".ogg"); target != want {
+				t.Errorf("link target %q, want %q", target, want)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != "ogg" {
+				t.Errorf("reading through the link: %q, %v", data, err)
+			}
+			if fileExists(path + ".link") {
+				t.Error("temporary link left behind")
+			}
+		})
+	}
+}
+
+func TestContentStoreIndex(t *testing.T) {
+	s, dir := newTestStore(t, linkHard)
+	for i := range storeSaveEvery {
+		if i == storeSaveEvery-1 && fileExists(s.indexPath()) {
+			t.Fatalf("index written after %d changes", i)
+		}
+		path := writeTestFile(t, dir, fmt.Sprintf("a/%d.bin", i), fmt.Sprint(i))
+		if _, err := s.add(fmt.Sprintf("document_%d", i), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !fileExists(s.indexPath()) {
+		t.Fatalf("index not written after %d changes", storeSaveEvery)
+	}
+	if s.unsaved != 0 {
+		t.Errorf("%d unsaved changes after writing the index", s.unsaved)
+	}
+
+	// The next run finds the stored files.
+	reopened := &contentStore{dir: s.dir, mode: linkHard}
+	if err := reopened.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.index.Files) != storeSaveEvery || len(reopened.index.Blobs) != storeSaveEvery {
+		t.Errorf("reloaded index has %d files and %d blobs, want %d", len(reopened.index.Files), len(reopened.index.Blobs), storeSaveEvery)
+	}
+	if _, ok, err := reopened.reuse("document_7", filepath.Join(dir, "b", "7.bin")); !ok || err != nil {
+		t.Errorf("reuse after reloading = %v, %v", ok, err)
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestFile(t, dir, "a", "x")
+	b := writeTestFile(t, dir, "b", "x")
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, filepath.Join(dir, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a, a, true},
+		{a, filepath.Join(dir, "link"), true},
+		{a, filepath.Join(dir, "hard"), true},
+		{a, b, false}, // Same content, different file
+		{a, filepath.Join(dir, "missing"), false},
+	}
+	for _, tt := range tests {
+		if got := sameFile(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameFile(%s, %s) = %v, want %v", filepath.Base(tt.a), filepath.Base(tt.b), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"go.uber.org/zap"
+)
+
+// maxFloodWaitRetries is how often a download is retried after FLOOD_WAIT errors.
+const maxFloodWaitRetries = 5
+
+// partSuffix is appended to files while they are being downloaded.
+const partSuffix = ".part"
+
+// downloadChunkSize is the upload.getFile limit. 1 MB must be divisible by it.
+const downloadChunkSize = 512 * 1024
+
+// partialMaxAge is how long an incomplete download is kept for resuming.
+const partialMaxAge = 7 * 24 * time.Hour
+
+// Limits of holding the admin log cursor back for failed media, see
+// downloadPool.holdBack. Without them, media failing on every run would keep
+// the cursor in place forever.
+const (
+	maxHoldBackRuns   = 3              // Runs in which an event's media failed before
+	adminLogRetention = 48 * time.Hour // Older events are gone from the admin log
+)
+
+// fetcher downloads files for every scan and capture of the process. It keeps
+// one connection pool per data center, so files stored on other DCs don't
+// need a new connection each time, and pauses all downloads while Telegram
+// asks us to wait (FLOOD_WAIT).
+type fetcher struct {
+	client      *telegram.Client
+	log         *zap.Logger
+	connections int64 // Connections per DC pool
+	retries     int   // Retries of transient errors per download
+	dedup       linkMode
+	catalog     bool // Record saved files in the catalogue of their output directory
+
+	mux       sync.Mutex
+	dcs       map[int]telegram.CloseInvoker
+	waitUntil time.Time                // No requests before this time
+	stores    map[string]*contentStore // Output directory -> content store, see contentStoreFor
+	catalogs  map[string]*catalog      // Output directory -> catalogue, see catalogFor
+
+	pathsMux sync.Mutex
+	paths    map[string]*pathLock // Destinations being downloaded to, see lockPath
+}
+
+// pathLock serialises downloads to one destination.
+type pathLock struct {
+	mux  sync.Mutex
+	refs int // Downloads holding or waiting for the lock
+}
+
+func newFetcher(client *telegram.Client, connections, retries int, dedup linkMode, useCatalog bool, log *zap.Logger) *fetcher {
+	return &fetcher{
+		client:      client,
+		log:         log,
+		connections: int64(connections),
+		retries:     retries,
+		dedup:       dedup,
+		catalog:     useCatalog,
+		dcs:         make(map[int]telegram.CloseInvoker),
+		stores:      make(map[string]*contentStore),
+		catalogs:    make(map[string]*catalog),
+		paths:       make(map[string]*pathLock),
+	}
+}
+
+// api returns the client to download files stored on dcID from.
+// Files on the current DC use the main connection.
+func (f *fetcher) api(ctx context.Context, dcID int) (*tg.Client, error) {
+	if dcID == 0 || dcID == f.client.Config().ThisDC {
+		return f.client.API(), nil
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if inv, ok := f.dcs[dcID]; ok {
+		return tg.NewClient(inv), nil
+	}
+	f.log.Debug("Connecting to data center for downloads", zap.Int("dc_id", dcID))
+	inv, err := f.client.DC(ctx, dcID, f.connections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DC %d: %w", dcID, err)
+	}
+	f.dcs[dcID] = inv
+	return tg.NewClient(inv), nil
+}
+
+// throttle waits until a pending FLOOD_WAIT has passed.
+func (f *fetcher) throttle(ctx context.Context) error {
+	f.mux.Lock()
+	wait := time.Until(f.waitUntil)
+	f.mux.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	return sleep(ctx, wait)
+}
+
+// floodWait makes every download wait for d.
+func (f *fetcher) floodWait(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if until := time.Now().Add(d); until.After(f.waitUntil) {
+		f.waitUntil = until
+	}
+}
+
+// download downloads loc from dcID to path. The file is written to a .part
+// file next to path and only renamed into place once it is complete and
+// flushed to disk, so path never holds a truncated file. The .part file is
+// kept on failure, so the next attempt continues where this one stopped.
+//
+// Transient errors are retried with exponential backoff and FLOOD_WAIT pauses
+// all downloads for the requested time. Other errors, including expired file
+// references, are returned as *downloadError right away.
+func (f *fetcher) download(ctx context.Context, loc tg.InputFileLocationClass, dcID int, path string) error {
+	// The admin log poll and real-time capture may save the same message at
+	// once. Only one of them writes the .part file, the other finds the
+	// finished file afterwards.
+	unlock := f.lockPath(path)
+	defer unlock()
+	if fileExists(path) {
+		return nil
+	}
+
+	var (
+		retries    int // Backoff retries used
+		floodWaits int
+	)
+	for attempt := 1; ; attempt++ {
+		if err := f.throttle(ctx); err != nil {
+			return &downloadError{Reason: reasonCanceled, Err: err, Attempts: attempt - 1}
+		}
+		api, err := f.api(ctx, dcID)
+		if err == nil {
+			err = f.downloadAtomic(ctx, api, loc, path)
+			if err == nil {
+				return nil
+			}
+		}
+
+		reason, retry := classifyError(err)
+		if reason == reasonFloodWait && floodWaits < maxFloodWaitRetries {
+			floodWaits++
+			d, _ := tgerr.AsFloodWait(err)
+			f.log.Warn("Telegram asked to slow down, pausing downloads", zap.Duration("wait", d), zap.String("path", path))
+			f.floodWait(d)
+			continue
+		}
+		if !retry || reason == reasonFloodWait || retries >= f.retries {
+			return &downloadError{Reason: reason, Err: err, Attempts: attempt}
+		}
+		retries++
+		delay := backoff(retries)
+		f.log.Warn("Download failed, retrying", zap.String("path", path), zap.String("reason", string(reason)), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		if err := sleep(ctx, delay); err != nil {
+			return &downloadError{Reason: reasonCanceled, Err: err, Attempts: attempt}
+		}
+	}
+}
+
+// lockPath locks the destination path for downloading. The returned
+// function releases it.
+func (f *fetcher) lockPath(path string) func() {
+	f.pathsMux.Lock()
+	l, ok := f.paths[path]
+	if !ok {
+		l = &pathLock{}
+		f.paths[path] = l
+	}
+	l.refs++
+	f.pathsMux.Unlock()
+
+	l.mux.Lock()
+	return func() {
+		l.mux.Unlock()
+		f.pathsMux.Lock()
+		defer f.pathsMux.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(f.paths, path)
+		}
+	}
+}
+
+// downloadAtomic downloads loc into the .part file of path and renames it
+// into place. An existing .part file is resumed from its current size, so
+// progress survives network errors, retries and restarts.
+func (f *fetcher) downloadAtomic(ctx context.Context, api *tg.Client, loc tg.InputFileLocationClass, path string) error {
+	part := path + partSuffix
+	out, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", part, err)
+	}
+	defer out.Close() // nolint:errcheck
+
+	info, err := out.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", part, err)
+	}
+	// upload.getFile requires offsets aligned to the chunk size, so a
+	// trailing incomplete chunk is downloaded again.
+	offset := info.Size() - info.Size()%downloadChunkSize
+	if err := out.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", part, err)
+	}
+	if offset > 0 {
+		f.log.Info("Resuming partial download", zap.String("path", path), zap.Int64("offset", offset))
+	}
+
+	for {
+		res, err := api.UploadGetFile(ctx, &tg.UploadGetFileRequest{
+			Location: loc,
+			Offset:   offset,
+			Limit:    downloadChunkSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get chunk at offset %d: %w", offset, err)
+		}
+		chunk, ok := res.(*tg.UploadFile)
+		if !ok {
+			return fmt.Errorf("unexpected response %T at offset %d", res, offset)
+		}
+		if len(chunk.Bytes) > 0 {
+			if _, err := out.WriteAt(chunk.Bytes, offset); err != nil {
+				return fmt.Errorf("failed to write %s: %w", part, err)
+			}
+			offset += int64(len(chunk.Bytes))
+		}
+		if len(chunk.Bytes) < downloadChunkSize {
+			break // Short chunk: end of file
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", part, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", part, err)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", part, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of dir to disk, so a file renamed into it
+// survives a crash. Windows can't sync directories, NTFS journals renames.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer d.Close() // nolint:errcheck
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", dir, err)
+	}
+	return nil
+}
+
+// removePartials deletes .part files in dir that haven't been touched for
+// maxAge. Recent ones are kept so their download can be resumed.
+func removePartials(dir string, maxAge time.Duration, log *zap.Logger) error {
+	deadline := time.Now().Add(-maxAge)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, partSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(deadline) {
+			return nil
+		}
+		log.Info("Removing stale incomplete download", zap.String("path", path), zap.Time("modified", info.ModTime()))
+		return os.Remove(path)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clean up incomplete downloads in %s: %w", dir, err)
+	}
+	return nil
+}
+
+// close closes the DC connection pools.
+func (f *fetcher) close() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for dcID, inv := range f.dcs {
+		if err := inv.Close(); err != nil {
+			f.log.Debug("Failed to close DC connection", zap.Int("dc_id", dcID), zap.Error(err))
+		}
+	}
+	f.dcs = make(map[int]telegram.CloseInvoker)
+}
+
+// downloadJob is a deleted media message waiting to be saved.
+type downloadJob struct {
+	msg     *tg.Message
+	dest    mediaDest
+	channel string           // Channel reference, for the failures file
+	eventID int64            // Admin log event the message came from
+	eventAt time.Time        // Date of the event
+	refresh refreshFunc      // Fetches the message again when its file reference expired
+	meta    *messageMetadata // Written as sidecar of the saved file, optional
+	thumbs  bool             // Also save thumbnails and previews
+	log     *zap.Logger
+}
+
+// downloadPool saves media with a bounded number of workers, so a large file
+// doesn't hold up the admin-log scan.
+type downloadPool struct {
+	f    *fetcher
+	jobs chan downloadJob
+	wg   sync.WaitGroup
+
+	saved  atomic.Int64 // Saved, already present or skipped
+	failed atomic.Int64
+
+	started time.Time // Failures recorded before were recorded by earlier runs
+
+	mux       sync.Mutex
+	retryFrom int64                    // Oldest admin log event whose media may be saved by a later run, 0 if none
+	earlier   map[string]map[int64]int // Output directory -> event ID -> earlier runs it failed in, see failedRuns
+}
+
+// newDownloadPool starts workers goroutines that run until wait is called.
+func newDownloadPool(ctx context.Context, f *fetcher, workers int) *downloadPool {
+	p := &downloadPool{
+		f:       f,
+		jobs:    make(chan downloadJob),
+		started: time.Now(),
+		earlier: make(map[string]map[int64]int),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				p.run(ctx, job)
+			}
+		}()
+	}
+	return p
+}
+
+func (p *downloadPool) run(ctx context.Context, job downloadJob) {
+	if job.thumbs {
+		// Embedded previews survive even if the full file can't be downloaded anymore.
+		defer saveThumbnails(ctx, p.f, job.msg, job.dest, job.log)
+	}
+	if err := saveMedia(ctx, p.f, job.msg, job.dest, job.refresh, job.meta, job.log); err != nil {
+		// Log warning but continue processing other messages
+		reason := failureReasonOf(err)
+		job.log.Warn("Failed to save media", zap.Int("msg_id", job.msg.ID), zap.String("reason", string(reason)), zap.Error(err))
+		p.failed.Add(1)
+		if reason == reasonCanceled || (reason.retryLater() && p.retryable(job)) {
+			p.holdBack(job.eventID)
+		}
+		if reason == reasonCanceled {
+			return // Not a failure of the message, it's retried next run
+		}
+		if err := recordFailure(job.dest.dir, failureRecord{
+			Time:     time.Now(),
+			Channel:  job.channel,
+			MsgID:    job.msg.ID,
+			EventID:  job.eventID,
+			Reason:   reason,
+			Error:    err.Error(),
+			Attempts: attemptsOf(err),
+		}); err != nil {
+			job.log.Warn("Failed to record failure", zap.Error(err))
+		}
+		return
+	}
+	p.saved.Add(1) // Increment counter only on successful save (or skipped)
+	job.log.Info("Successfully processed/saved media for message", zap.Int("msg_id", job.msg.ID))
+}
+
+// holdBack remembers that the media of eventID should be saved again by the
+// next run, see oldestRetry.
+func (p *downloadPool) holdBack(eventID int64) {
+	if eventID == 0 {
+		return
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.retryFrom == 0 || eventID < p.retryFrom {
+		p.retryFrom = eventID
+	}
+}
+
+// retryable reports whether the next run should try the failed job again:
+// its event is still in the admin log and didn't fail in too many runs yet.
+func (p *downloadPool) retryable(job downloadJob) bool {
+	if !job.eventAt.IsZero() && time.Since(job.eventAt) > adminLogRetention {
+		return false
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	counts, ok := p.earlier[job.dest.dir]
+	if !ok {
+		var err error
+		if counts, err = failedRuns(job.dest.dir, p.started); err != nil {
+			job.log.Warn("Failed to read earlier failures", zap.Error(err))
+		}
+		p.earlier[job.dest.dir] = counts // nil if unreadable, every event is retried then
+	}
+	if runs := counts[job.eventID]; runs >= maxHoldBackRuns {
+		job.log.Warn("Media failed in too many runs, not trying again", zap.Int64("event_id", job.eventID), zap.Int("runs", runs+1))
+		return false
+	}
+	return true
+}
+
+// oldestRetry returns the oldest admin log event whose media failed with an
+// error a later run may not hit, or 0 if there is none. Call it after wait.
+func (p *downloadPool) oldestRetry() int64 {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.retryFrom
+}
+
+// submit queues a job, blocking while all workers are busy.
+func (p *downloadPool) submit(ctx context.Context, job downloadJob) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait stops accepting jobs, waits for the running ones and returns the
+// number of saved and failed messages.
+func (p *downloadPool) wait() (saved, failed int) {
+	close(p.jobs)
+	p.wg.Wait()
+	return int(p.saved.Load()), int(p.failed.Load())
+}
+
+// mediaDCID returns the data center a message's file is stored on, or 0 if unknown.
+func mediaDCID(media tg.MessageMediaClass) int {
+	switch m := media.(type) {
+	case *tg.MessageMediaDocument:
+		if doc, ok := m.Document.AsNotEmpty(); ok {
+			return doc.DCID
+		}
+	case *tg.MessageMediaPhoto:
+		if photo, ok := m.Photo.AsNotEmpty(); ok {
+			return photo.DCID
+		}
+	}
+	return 0
+}
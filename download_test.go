@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// testDC is the data center the fake file source is registered as.
+const testDC = 2
+
+// fakeFileSource answers upload.getFile requests with chunks of data, like a
+// Telegram data center.
+type fakeFileSource struct {
+	data   []byte
+	delay  time.Duration // Per chunk, so concurrent downloads overlap
+	failAt int64         // Fail requests from this offset on, if set
+
+	mux     sync.Mutex
+	offsets []int64 // Requested offsets
+}
+
+func (s *fakeFileSource) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	req, ok := input.(*tg.UploadGetFileRequest)
+	if !ok {
+		return fmt.Errorf("unexpected request %T", input)
+	}
+	s.mux.Lock()
+	s.offsets = append(s.offsets, req.Offset)
+	s.mux.Unlock()
+	if req.Offset%downloadChunkSize != 0 {
+		return fmt.Errorf("offset %d isn't aligned", req.Offset)
+	}
+	if s.failAt > 0 && req.Offset >= s.failAt {
+		return errors.New("connection reset")
+	}
+	time.Sleep(s.delay)
+
+	start := min(req.Offset, int64(len(s.data)))
+	end := min(start+int64(req.Limit), int64(len(s.data)))
+	var b bin.Buffer
+	if err := (&tg.UploadFile{Type: &tg.StorageFileUnknown{}, Bytes: s.data[start:end]}).Encode(&b); err != nil {
+		return err
+	}
+	return output.Decode(&b)
+}
+
+func (s *fakeFileSource) Close() error { return nil }
+
+func (s *fakeFileSource) requested() []int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]int64(nil), s.offsets...)
+}
+
+// newTestFetcher returns a fetcher downloading from src, which is never
+// connected to Telegram.
+func newTestFetcher(src *fakeFileSource) *fetcher {
+	f := newFetcher(telegram.NewClient(1, "hash", telegram.Options{}), 1, 0, linkNone, false, zap.NewNop())
+	f.dcs[testDC] = src
+	return f
+}
+
+// testData returns n bytes of a recognisable pattern.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestDownloadSameTarget(t *testing.T) {
+	src := &fakeFileSource{data: testData(downloadChunkSize + downloadChunkSize/2), delay: 20 * time.Millisecond}
+	f := newTestFetcher(src)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	loc := &tg.InputDocumentFileLocation{ID: 1}
+
+	// The admin log poll and real-time capture save the same message.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.download(context.Background(), loc, testDC, path)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src.data) {
+		t.Errorf("file has %d bytes, want the %d bytes of the source", len(got), len(src.data))
+	}
+	if offsets := src.requested(); len(offsets) != 2 {
+		t.Errorf("requested offsets %v, want the file downloaded once", offsets)
+	}
+	if fileExists(path + partSuffix) {
+		t.Error(".part file left behind")
+	}
+	if len(f.paths) != 0 {
+		t.Errorf("%d path locks left behind", len(f.paths))
+	}
+}
+
+func TestDownloadAtomicResume(t *testing.T) {
+	data := testData(2*downloadChunkSize + 100)
+	tests := []struct {
+		name       string
+		part       []byte // Existing .part file
+		wantOffset []int64
+	}{
+		{"fresh", nil, []int64{0, downloadChunkSize, 2 * downloadChunkSize}},
+		{"aligned", data[:downloadChunkSize], []int64{downloadChunkSize, 2 * downloadChunkSize}},
+		// The trailing incomplete chunk is garbage, as after a crash
+		// while writing it: it's truncated and downloaded again.
+		{"misaligned", append(bytes.Clone(data[:downloadChunkSize]), bytes.Repeat([]byte{0xff}, 1000)...), []int64{downloadChunkSize, 2 * downloadChunkSize}},
+		{"short", bytes.Repeat([]byte{0xff}, 1000), []int64{0, downloadChunkSize, 2 * downloadChunkSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeFileSource{data: data}
+			f := newTestFetcher(src)
+			path := filepath.Join(t.TempDir(), "file.bin")
+			if tt.part != nil {
+				if err := os.WriteFile(path+partSuffix, tt.part, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			api, err := f.api(context.Background(), testDC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.downloadAtomic(context.Background(), api, &tg.InputDocumentFileLocation{ID: 1}, path); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("file differs from the source")
+			}
+			if offsets := src.requested(); fmt.Sprint(offsets) != fmt.Sprint(tt.wantOffset) {
+				t.Errorf("requested offsets %v, want %v", offsets, tt.wantOffset)
+			}
+			if fileExists(path + partSuffix) {
+				t.Error(".part file left behind")
+			}
+		})
+	}
+}
+
+func TestDownloadKeepsPartOnFailure(t *testing.T) {
+	data := testData(2 * downloadChunkSize)
+	src := &fakeFileSource{data: data, failAt: downloadChunkSize} // Like a dropped connection
+	f := newTestFetcher(src)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	loc := &tg.InputDocumentFileLocation{ID: 1}
+	if err := f.download(context.Background(), loc, testDC, path); err == nil {
+		t.Fatal("download succeeded, want the injected failure")
+	}
+	if fileExists(path) {
+		t.Fatal("incomplete file moved into place")
+	}
+	if info, err := os.Stat(path + partSuffix); err != nil || info.Size() != downloadChunkSize {
+		t.Fatalf(".part file after the failure: %v, %v", info, err)
+	}
+
+	src.failAt = 0
+	if err := f.download(context.Background(), loc, testDC, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("resumed file differs from the source")
+	}
+	want := []int64{0, downloadChunkSize, downloadChunkSize, 2 * downloadChunkSize}
+	if offsets := src.requested(); fmt.Sprint(offsets) != fmt.Sprint(want) {
+		t.Errorf("requested offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestRemovePartials(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-partialMaxAge - time.Hour)
+	files := map[string]time.Time{
+		"a/stale.jpg.part":  old,
+		"a/recent.mp4.part": time.Now().Add(-time.Hour),
+		"a/old.jpg":         old, // Complete files are never touched
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removePartials(dir, partialMaxAge, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a/stale.jpg.part": false, "a/recent.mp4.part": true, "a/old.jpg": true} {
+		if got := fileExists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s exists: %v, want %v", name, got, want)
+		}
+	}
+	if err := removePartials(filepath.Join(dir, "missing"), partialMaxAge, zap.NewNop()); err != nil {
+		t.Errorf("missing directory: %v", err)
+	}
+}
+
+func TestDownloadPoolRetryable(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Now()
+	for _, rec := range []failureRecord{
+		{Time: started.Add(-3 * time.Hour), EventID: 5, Reason: reasonFileReference},
+		{Time: started.Add(-2 * time.Hour), EventID: 5, Reason: reasonFileReference},
+		{Time: started.Add(-time.Hour), EventID: 5, Reason: reasonFileReference},
+		{Time: started.Add(-time.Hour), EventID: 6, Reason: reasonNetwork},
+		{Time: started.Add(time.Second), EventID: 7, Reason: reasonNetwork}, // This run
+		{Time: started.Add(time.Second), EventID: 7, Reason: reasonNetwork},
+		{Time: started.Add(time.Second), EventID: 7, Reason: reasonNetwork},
+	} {
+		if err := recordFailure(dir, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &downloadPool{started: started, earlier: make(map[string]map[int64]int)}
+
+	tests := []struct {
+		eventID int64
+		eventAt time.Time
+		want    bool
+	}{
+		{5, started.Add(-4 * time.Hour), false}, // Failed in three runs already
+		{6, started.Add(-4 * time.Hour), true},
+		{7, started.Add(-time.Hour), true},
+		{8, started.Add(-time.Hour), true},
+		{8, started.Add(-adminLogRetention - time.Hour), false}, // Gone from the admin log
+	}
+	for _, tt := range tests {
+		job := downloadJob{dest: mediaDest{dir: dir}, eventID: tt.eventID, eventAt: tt.eventAt, log: zap.NewNop()}
+		if got := p.retryable(job); got != tt.want {
+			t.Errorf("retryable(event %d at %s) = %v, want %v", tt.eventID, tt.eventAt, got, tt.want)
+		}
+	}
+	if reasonFilesystem.retryLater() {
+		t.Error("filesystem errors hold the cursor back")
+	}
+}
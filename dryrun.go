@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// dryRunItem is a deleted message a backup run would save.
+type dryRunItem struct {
+	Channel   string    `json:"channel"`
+	MsgID     int       `json:"msg_id"`
+	EventID   int64     `json:"event_id"`
+	Date      time.Time `json:"date"`
+	Sender    int64     `json:"sender,omitempty"`
+	DeletedBy int64     `json:"deleted_by"`
+	From      string    `json:"from,omitempty"`    // Name of Sender, if known
+	Deleter   string    `json:"deleter,omitempty"` // Name of DeletedBy, if known
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size,omitempty"` // 0 if unknown
+	Target    string    `json:"target,omitempty"`
+	Exists    bool      `json:"exists,omitempty"` // Already saved, would be skipped
+	Error     string    `json:"error,omitempty"`  // Why it can't be saved
+}
+
+// dryRunReport is the JSON output of a dry run.
+type dryRunReport struct {
+	Items      []dryRunItem `json:"items"`
+	Messages   int          `json:"messages"`
+	TotalBytes int64        `json:"total_bytes"` // Of the files not saved yet
+	Existing   int          `json:"existing"`
+	Filtered   int          `json:"filtered"`
+}
+
+// dryRunAll walks the admin log of every channel like scanAll does and reports
+// what would be saved, without downloading or writing anything.
+func dryRunAll(ctx context.Context, client *telegram.Client, channels []ChannelConfig, opts runOptions, out io.Writer, log *zap.Logger) error {
+	var (
+		report dryRunReport
+		errs   []error
+	)
+	for _, ch := range channels {
+		chLog := log.With(zap.Stringer("channel", ch.ref))
+		peer, err := lookupPeer(ctx, client.API(), ch, chLog)
+		if err == nil && peer.Channel == nil {
+			chLog.Warn("Basic groups and private chats have no admin log, use \"watch -realtime\" for them. Skipping.")
+			continue
+		}
+		if err == nil {
+			err = dryRunChannel(ctx, client.API(), ch, peer.Channel, opts, &report, chLog)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			chLog.Error("Failed to process channel", zap.Error(err))
+			errs = append(errs, fmt.Errorf("channel %s: %w", ch.ref, err))
+		}
+	}
+
+	report.Messages = len(report.Items)
+	for _, item := range report.Items {
+		if item.Exists {
+			report.Existing++
+		} else if item.Kind != "text" {
+			report.TotalBytes += item.Size
+		}
+	}
+	var err error
+	if opts.JSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = printDryRun(out, report)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to write report: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// dryRunChannel adds the deleted messages of one channel to report. The saved
+// cursor is honoured, so the report shows what the next run would do.
+func dryRunChannel(ctx context.Context, api *tg.Client, ch ChannelConfig, channelInfo *tg.Channel, opts runOptions, report *dryRunReport, log *zap.Logger) error {
+	// Like scanChannel, the catalogue has a copy of the cursor if the state
+	// directory was lost. It's only read, a dry run writes nothing.
+	var cat *catalog
+	if opts.Catalog {
+		c, err := openCatalogReadOnly(ch.OutputDir)
+		if err != nil {
+			log.Warn("Failed to open catalogue", zap.String("output_dir", ch.OutputDir), zap.Error(err))
+		} else if c != nil {
+			defer c.close() // nolint:errcheck
+			cat = c
+		}
+	}
+	st, err := loadCursor(statePath(ch.OutputDir, channelInfo.ID), channelInfo.ID, cat, log)
+	if err != nil {
+		return err
+	}
+	minID := st.LastEventID
+	if opts.Full {
+		minID = 0
+	}
+	chat := chatMeta{Kind: kindChannel.String(), ID: channelInfo.ID, Title: channelInfo.Title, Ref: ch.ref.String()}
+	textLog := textLogPath(ch.OutputDir, chat)
+	logged, err := loggedMessageIDs(textLog + ".jsonl")
+	if err != nil {
+		return err
+	}
+
+	names := entitiesFor(ch.OutputDir)
+	return walkAdminLog(ctx, api, channelInfo, minID, log, func(ev tg.ChannelAdminLogEvent, res *tg.ChannelsAdminLogResults) error {
+		names.addResults(res) // In memory only, a dry run writes nothing
+		del, ok := ev.Action.(*tg.ChannelAdminLogEventActionDeleteMessage)
+		if !ok {
+			return nil
+		}
+		msg, ok := del.Message.(*tg.Message)
+		if !ok {
+			return nil
+		}
+		if accepted, _ := ch.accepts(opts.Filter, msg, ev.UserID); !accepted {
+			report.Filtered++
+			return nil
+		}
+
+		item := dryRunItem{
+			Channel:   ch.ref.String(),
+			MsgID:     msg.ID,
+			EventID:   ev.ID,
+			Date:      unixTime(msg.Date),
+			Sender:    senderID(msg),
+			DeletedBy: ev.UserID,
+			Kind:      messageKind(msg),
+		}
+		if key, ok := senderKeyOf(msg); ok {
+			if e, ok := names.lookup(key); ok {
+				item.From = e.label()
+			}
+		}
+		if e, ok := names.user(ev.UserID); ok {
+			item.Deleter = e.label()
+		}
+		item.Size, _ = mediaSizeAndType(msg)
+		if msg.Media == nil {
+			item.Size = int64(len(msg.Message))
+			item.Target = textLog + ".md"
+			item.Exists = logged[msg.ID]
+		} else if target, err := newMediaTarget(msg, ch.adminLogDest(opts.Layout, chat, ev), zap.NewNop()); err != nil {
+			item.Error = err.Error()
+		} else {
+			item.Target = target.destPath
+			item.Exists = fileExists(target.destPath)
+		}
+		report.Items = append(report.Items, item)
+		return nil
+	})
+}
+
+// printDryRun writes the report as a table.
+func printDryRun(out io.Writer, report dryRunReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tMSG ID\tDATE\tSENDER\tDELETED BY\tKIND\tSIZE\tTARGET")
+	for _, item := range report.Items {
+		target := item.Target
+		switch {
+		case item.Error != "":
+			target = "(cannot save: " + item.Error + ")"
+		case item.Exists:
+			target += " (exists)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.Channel, item.MsgID, item.Date.Local().Format("2006-01-02 15:04"), orID(item.From, item.Sender), orID(item.Deleter, item.DeletedBy), item.Kind, formatSize(item.Size), target)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%d deleted messages, %s to download, %d already saved, %d filtered out.\n",
+		report.Messages, formatSize(report.TotalBytes), report.Existing, report.Filtered)
+	return err
+}
+
+// orID returns name, or id if the name isn't known.
+func orID(name string, id int64) string {
+	if name != "" {
+		return name
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// formatSize formats a byte count for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gotd/td/tg"
+)
+
+// entitiesFileName is the file inside the state directory caching the names
+// of users and chats seen in admin log results and updates.
+const entitiesFileName = "entities.json"
+
+// entityInfo is the name of a user, basic group or channel.
+type entityInfo struct {
+	Kind     string `json:"kind"` // user, chat or channel
+	ID       int64  `json:"id"`
+	Username string `json:"username,omitempty"`
+	Name     string `json:"name,omitempty"` // First and last name, or title
+}
+
+// label returns the readable form of the entity: "@username (id)", or
+// "First Last (id)" without a username. The ID suffix stays the same when
+// the entity is renamed, see stableDirName.
+func (e entityInfo) label() string {
+	switch {
+	case e.Username != "":
+		return fmt.Sprintf("@%s (%d)", e.Username, e.ID)
+	case e.Name != "":
+		return fmt.Sprintf("%s (%d)", e.Name, e.ID)
+	default:
+		return strconv.FormatInt(e.ID, 10)
+	}
+}
+
+// entityCache remembers the names of users and chats of one output
+// directory. Admin log pages and updates carry them next to the messages,
+// so no extra requests are needed.
+type entityCache struct {
+	path string
+
+	mux      sync.Mutex
+	entities map[peerKey]entityInfo
+	changed  bool // Not written yet
+}
+
+var (
+	entityCachesMux sync.Mutex
+	entityCaches    = make(map[string]*entityCache) // Output directory -> cache
+)
+
+// entitiesFor returns the entity cache of an output directory, loading it on
+// first use. An unreadable cache file is ignored, names are learned again.
+func entitiesFor(outputDir string) *entityCache {
+	entityCachesMux.Lock()
+	defer entityCachesMux.Unlock()
+	if c, ok := entityCaches[outputDir]; ok {
+		return c
+	}
+	c := &entityCache{
+		path:     filepath.Join(outputDir, stateDirName, entitiesFileName),
+		entities: make(map[peerKey]entityInfo),
+	}
+	_ = c.load()
+	entityCaches[outputDir] = c
+	return c
+}
+
+func (c *entityCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", c.path, err)
+	}
+	var list []entityInfo
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", c.path, err)
+	}
+	for _, e := range list {
+		if key, ok := entityKey(e.Kind, e.ID); ok {
+			c.entities[key] = e
+		}
+	}
+	return nil
+}
+
+// save writes the cache if it changed since the last save.
+func (c *entityCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.changed {
+		return nil
+	}
+	list := make([]entityInfo, 0, len(c.entities))
+	for _, e := range c.entities {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].ID < list[j].ID
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode entities: %w", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
+
+func entityKey(kind string, id int64) (peerKey, bool) {
+	switch kind {
+	case kindUser.String():
+		return peerKey{Kind: kindUser, ID: id}, true
+	case kindChat.String():
+		return peerKey{Kind: kindChat, ID: id}, true
+	case kindChannel.String():
+		return peerKey{Kind: kindChannel, ID: id}, true
+	default:
+		return peerKey{}, false
+	}
+}
+
+func (c *entityCache) put(key peerKey, e entityInfo) {
+	if old, ok := c.entities[key]; ok && old == e {
+		return
+	}
+	c.entities[key] = e
+	c.changed = true
+}
+
+// addUsers remembers the names of users.
+func (c *entityCache) addUsers(users ...*tg.User) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, u := range users {
+		if u == nil {
+			continue
+		}
+		c.put(peerKey{Kind: kindUser, ID: u.ID}, entityInfo{
+			Kind:     kindUser.String(),
+			ID:       u.ID,
+			Username: u.Username,
+			Name:     strings.TrimSpace(u.FirstName + " " + u.LastName),
+		})
+	}
+}
+
+// addChats remembers the titles of basic groups and channels.
+func (c *entityCache) addChats(chats ...tg.ChatClass) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, chat := range chats {
+		switch chat := chat.(type) {
+		case *tg.Chat:
+			c.put(peerKey{Kind: kindChat, ID: chat.ID}, entityInfo{Kind: kindChat.String(), ID: chat.ID, Name: chat.Title})
+		case *tg.Channel:
+			c.put(peerKey{Kind: kindChannel, ID: chat.ID}, entityInfo{Kind: kindChannel.String(), ID: chat.ID, Username: chat.Username, Name: chat.Title})
+		}
+	}
+}
+
+// addPeers remembers the users and chats included in a response.
+func (c *entityCache) addPeers(users []tg.UserClass, chats []tg.ChatClass) {
+	for _, u := range users {
+		if user, ok := u.(*tg.User); ok {
+			c.addUsers(user)
+		}
+	}
+	c.addChats(chats...)
+}
+
+// addResults remembers the users and chats of an admin log page.
+func (c *entityCache) addResults(res *tg.ChannelsAdminLogResults) {
+	c.addPeers(res.Users, res.Chats)
+}
+
+// addEntities remembers the users and chats of an update.
+func (c *entityCache) addEntities(e tg.Entities) {
+	for _, user := range e.Users {
+		c.addUsers(user)
+	}
+	for _, chat := range e.Chats {
+		c.addChats(chat)
+	}
+	for _, channel := range e.Channels {
+		c.addChats(channel)
+	}
+}
+
+// lookup returns the cached name of a peer.
+func (c *entityCache) lookup(key peerKey) (entityInfo, bool) {
+	if c == nil {
+		return entityInfo{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entities[key]
+	return e, ok
+}
+
+// user returns the cached name of a user.
+func (c *entityCache) user(id int64) (entityInfo, bool) {
+	return c.lookup(peerKey{Kind: kindUser, ID: id})
+}
+
+// describe adds the known names of the sender and the deleting user to meta.
+func (c *entityCache) describe(meta *messageMetadata) {
+	if c == nil || meta == nil {
+		return
+	}
+	if s := meta.Sender; s != nil {
+		if key, ok := entityKey(s.Kind, s.ID); ok {
+			if e, ok := c.lookup(key); ok {
+				s.Username, s.Name = e.Username, e.Name
+			}
+		}
+	}
+	if id := meta.Deletion.DeletedBy; id != 0 {
+		if e, ok := c.user(id); ok {
+			meta.Deletion.Deleter = &peerMeta{Kind: e.Kind, ID: e.ID, Username: e.Username, Name: e.Name}
+		}
+	}
+}
+
+// stableDirName returns the directory for an entity inside parent. If a
+// directory of the entity exists under another name, because it was renamed
+// or saved by a version using plain IDs, that one is reused, so an entity's
+// files stay together.
+func stableDirName(parent, name, plain string, id int64) string {
+	if fileExists(filepath.Join(parent, name)) {
+		return name
+	}
+	if plain != "" && fileExists(filepath.Join(parent, plain)) {
+		return plain
+	}
+	entries, _ := os.ReadDir(parent) // Sorted by name
+	suffix := " (" + strconv.FormatInt(id, 10) + ")"
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), suffix) {
+			return entry.Name()
+		}
+	}
+	return name
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// exportFormats are the formats of the export command.
+var exportFormats = []string{"html"}
+
+// runExport runs the export command and returns the exit code. Like the
+// query commands it only reads the output directories.
+func runExport(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "html" {
+		fmt.Fprintf(os.Stderr, "Usage: export html [-channel chat] [-dir dir] [-out dir]. Available formats: %s\n", strings.Join(exportFormats, ", "))
+		return 2
+	}
+	fs := flag.NewFlagSet("export html", flag.ExitOnError)
+	var (
+		dirs   []string
+		filter archiveFilter
+	)
+	fs.Func("dir", "output directory to read, may be repeated (default: the output directories of the config)", listFlag(&dirs))
+	fs.StringVar(&filter.channel, "channel", "", "only export this chat: its reference from the config, ID or part of the title (default: every chat)")
+	outDir := fs.String("out", "export", "directory to write the reports to, one per chat")
+	maxEmbed := fs.String("max-embed", "50MB", "larger files are linked instead of embedded into the report")
+	_ = fs.Parse(args[1:]) // ExitOnError handles failures
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "export html takes no arguments, got %q\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+	limit, err := parseSize(*maxEmbed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -max-embed: %v\n", err)
+		return 2
+	}
+
+	entries, err := loadArchive(archiveDirs(dirs))
+	if err != nil {
+		// Report unreadable files, but export what could be read.
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	chats := make(map[string][]archiveEntry) // Report file name -> entries
+	for _, e := range entries {
+		if filter.match(e) {
+			name := fmt.Sprintf("%s_%d.html", e.Meta.Chat.Kind, e.Meta.Chat.ID)
+			chats[name] = append(chats[name], e)
+		}
+	}
+	if len(chats) == 0 {
+		fmt.Fprintln(os.Stderr, "No recovered messages to export")
+		return 1
+	}
+	names := make([]string, 0, len(chats))
+	for name := range chats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *outDir, err)
+		return 1
+	}
+	for _, name := range names {
+		path := filepath.Join(*outDir, name)
+		report := newExportReport(chats[name], path, limit)
+		if err := writeExportReport(path, report); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export %s: %v\n", report.Title, err)
+			return 1
+		}
+		fmt.Fprintf(out, "Wrote %s: %d messages of %s\n", path, report.Messages, report.Title)
+	}
+	return 0
+}
+
+// Report model: days of messages, each message a bubble. The messages of an
+// album share one bubble, as in Telegram.
+type (
+	exportReport struct {
+		Title     string
+		Chat      chatMeta
+		Generated string
+		Messages  int
+		Days      []*exportDay
+	}
+	exportDay struct {
+		Date    string
+		Bubbles []*exportBubble
+	}
+	exportBubble struct {
+		IDs     []int
+		Sender  string
+		Color   int // Index of the sender's name color
+		Forward string
+		ReplyTo int
+		Posted  string
+		Edited  bool
+		Caption template.HTML
+		Deleted string
+		Deleter string
+		Media   []exportMedia
+	}
+	exportMedia struct {
+		Name     string
+		Size     string
+		Kind     string       // image, video, audio or file
+		Src      template.URL // Data URI, or relative path of a large file. Data is in the page once: in the preview, or the link if there's none
+		Embedded bool
+		Degraded bool
+		Missing  string // Why the file couldn't be included
+	}
+)
+
+// newExportReport builds the report of one chat's entries. Files larger
+// than maxEmbed are linked relative to reportPath.
+func newExportReport(entries []archiveEntry, reportPath string, maxEmbed int64) *exportReport {
+	sorted := slices.Clone(entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Meta, sorted[j].Meta
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return a.MsgID < b.MsgID
+	})
+	report := &exportReport{
+		Title:     sorted[0].channel(),
+		Chat:      sorted[0].Meta.Chat,
+		Generated: time.Now().Format("2006-01-02 15:04"),
+	}
+	if t := report.Chat.Title; t != "" {
+		report.Title = t
+	}
+
+	var (
+		bubbles = make(map[string]*exportBubble) // Album or message -> bubble
+		seen    = make(map[string]bool)          // Messages
+		day     *exportDay
+	)
+	for _, e := range sorted {
+		key := e.messageID()
+		if !seen[key] {
+			seen[key] = true
+			report.Messages++
+		}
+		if g := e.Meta.GroupedID; g != 0 {
+			key = fmt.Sprintf("%s|album %d", e.Dir, g)
+		}
+		b, ok := bubbles[key]
+		if !ok {
+			date := e.Meta.Date.Local().Format("2 January 2006")
+			if day == nil || day.Date != date {
+				day = &exportDay{Date: date}
+				report.Days = append(report.Days, day)
+			}
+			b = newExportBubble(e)
+			bubbles[key] = b
+			day.Bubbles = append(day.Bubbles, b)
+		}
+		if len(b.IDs) == 0 || b.IDs[len(b.IDs)-1] != e.Meta.MsgID {
+			b.IDs = append(b.IDs, e.Meta.MsgID)
+		}
+		if b.Caption == "" && e.Meta.Text != "" {
+			b.Caption = template.HTML(renderHTML(e.Meta.Text, e.Meta.Entities))
+		}
+		if e.Path != "" {
+			b.Media = append(b.Media, exportMediaOf(e, reportPath, maxEmbed))
+		}
+	}
+	return report
+}
+
+func newExportBubble(e archiveEntry) *exportBubble {
+	meta := e.Meta
+	b := &exportBubble{
+		Sender:  displayName(e),
+		Posted:  meta.Date.Local().Format("15:04"),
+		Edited:  meta.EditDate != nil,
+		Deleted: formatLocal(meta.Deletion.DeletedAt),
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(b.Sender))
+	b.Color = int(h.Sum32() % 7)
+	if d := e.deleter(); d != nil {
+		b.Deleter = d.label()
+	}
+	if meta.ReplyTo != nil {
+		b.ReplyTo = meta.ReplyTo.MsgID
+	}
+	if fwd := meta.Forward; fwd != nil {
+		switch {
+		case fwd.From != nil:
+			b.Forward = fwd.From.label()
+		case fwd.FromName != "":
+			b.Forward = fwd.FromName
+		}
+	}
+	return b
+}
+
+// displayName returns the sender as Telegram shows it: the name, else the
+// username, the signature of a channel post, or the chat itself.
+func displayName(e archiveEntry) string {
+	if s := e.Meta.Sender; s != nil {
+		switch {
+		case s.Name != "":
+			return s.Name
+		case s.Username != "":
+			return "@" + s.Username
+		case e.Meta.Author == "":
+			return s.label()
+		}
+	}
+	if e.Meta.Author != "" {
+		return e.Meta.Author
+	}
+	return e.channel()
+}
+
+// exportMediaOf embeds the saved file of e as a data URI, or links it if
+// it's larger than maxEmbed.
+func exportMediaOf(e archiveEntry, reportPath string, maxEmbed int64) exportMedia {
+	m := exportMedia{Name: filepath.Base(e.Path), Kind: previewOf(e)}
+	if m.Kind == "" {
+		m.Kind = "file"
+	}
+	if e.Meta.File != nil {
+		m.Degraded = e.Meta.File.Degraded
+	}
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		m.Missing = "file not found"
+		return m
+	}
+	m.Size = formatSize(info.Size())
+	if info.Size() > maxEmbed {
+		// Relative to the report, so the export and backup can be moved together.
+		target, err := filepath.Abs(e.Path)
+		if err == nil {
+			if dir, err := filepath.Abs(filepath.Dir(reportPath)); err == nil {
+				if rel, err := filepath.Rel(dir, target); err == nil {
+					target = rel
+				}
+			}
+		}
+		m.Src = template.URL((&url.URL{Path: filepath.ToSlash(target)}).String())
+		return m
+	}
+	data, err := os.ReadFile(e.Path)
+	if err != nil {
+		m.Missing = err.Error()
+		return m
+	}
+	m.Src = template.URL("data:" + mimeTypeOf(e) + ";base64," + base64.StdEncoding.EncodeToString(data))
+	m.Embedded = true
+	return m
+}
+
+// renderHTML renders text with its entities as HTML.
+func renderHTML(text string, entities []entityMeta) string {
+	units := utf16.Encode([]rune(text))
+	markers := make([]textMarker, 0, len(entities))
+	for _, e := range entities {
+		var entityText string
+		if start, end := e.Offset, e.Offset+e.Length; start >= 0 && start < end && end <= len(units) {
+			entityText = string(utf16.Decode(units[start:end]))
+		}
+		open, close := htmlMarkers(e, entityText)
+		if open != "" {
+			markers = append(markers, textMarker{open: open, close: close, start: e.Offset, end: e.Offset + e.Length})
+		}
+	}
+	return renderEntities(text, markers, html.EscapeString)
+}
+
+// htmlMarkers returns the opening and closing HTML of an entity. Entities
+// without an HTML equivalent are kept as plain text.
+func htmlMarkers(e entityMeta, text string) (string, string) {
+	link := func(href string) (string, string) {
+		u, err := url.Parse(href)
+		if err != nil {
+			return "", ""
+		}
+		switch u.Scheme {
+		case "http", "https", "tg", "mailto":
+			return `<a href="` + html.EscapeString(u.String()) + `">`, "</a>"
+		default:
+			return "", "" // javascript: and the like
+		}
+	}
+	switch e.Type {
+	case "bold":
+		return "<b>", "</b>"
+	case "italic":
+		return "<i>", "</i>"
+	case "underline":
+		return "<u>", "</u>"
+	case "strike":
+		return "<s>", "</s>"
+	case "spoiler":
+		return `<span class="spoiler">`, "</span>"
+	case "code":
+		return "<code>", "</code>"
+	case "pre":
+		if e.Language != "" {
+			return `<pre><code class="language-` + html.EscapeString(e.Language) + `">`, "</code></pre>"
+		}
+		return "<pre><code>", "</code></pre>"
+	case "blockquote":
+		return "<blockquote>", "</blockquote>"
+	case "text_url":
+		return link(e.URL)
+	case "url":
+		if !strings.Contains(text, "://") {
+			text = "https://" + text
+		}
+		return link(text)
+	case "email":
+		return link("mailto:" + text)
+	case "mention":
+		return link("https://t.me/" + strings.TrimPrefix(text, "@"))
+	case "mention_name":
+		return link(fmt.Sprintf("tg://user?id=%d", e.UserID))
+	case "hashtag", "cashtag", "bot_command":
+		return `<span class="tag">`, "</span>"
+	default:
+		return "", ""
+	}
+}
+
+func writeExportReport(path string, report *exportReport) error {
+	var b strings.Builder
+	if err := exportTemplate.Execute(&b, report); err != nil {
+		return fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Deleted messages · {{.Title}}</title>
+<style>
+body { margin: 0; font: 15px/1.4 system-ui, sans-serif; background: #dfe7ce; color: #000; }
+header { position: sticky; top: 0; background: #fff; padding: .7em 1.2em; box-shadow: 0 1px 3px #0003; }
+header h1 { font-size: 1.1em; margin: 0; }
+header div { font-size: .85em; color: #707579; }
+main { max-width: 720px; margin: 0 auto; padding: 1em; }
+.day { text-align: center; margin: 1em 0; }
+.day span { background: #0004; color: #fff; border-radius: 1em; padding: .2em .8em; font-size: .85em; }
+.bubble { background: #fff; border-radius: 12px; padding: .5em .7em; margin: .5em 0; max-width: 85%; width: fit-content; box-shadow: 0 1px 1px #0002; overflow-wrap: anywhere; }
+.sender { font-weight: 600; font-size: .9em; }
+.c0 { color: #e17076; } .c1 { color: #eda86c; } .c2 { color: #a695e7; } .c3 { color: #7bc862; } .c4 { color: #6ec9cb; } .c5 { color: #65aadd; } .c6 { color: #ee7aae; }
+.forward, .reply { font-size: .85em; color: #3a8cc9; }
+.media img, .media video { display: block; max-width: 100%; max-height: 480px; border-radius: 8px; margin: .3em 0; }
+.media audio { width: 100%; }
+.file { font-size: .9em; margin: .3em 0; }
+.note { color: #b45309; font-size: .85em; }
+.caption { white-space: pre-wrap; margin: .2em 0; }
+.caption pre { background: #f4f4f5; padding: .5em; border-radius: 6px; overflow-x: auto; }
+.caption blockquote { border-left: 3px solid #3a8cc9; margin: .2em 0; padding-left: .6em; }
+.spoiler { background: #999; color: transparent; border-radius: 3px; }
+.spoiler:hover { color: inherit; background: none; }
+.tag, a { color: #168acd; }
+.footer { display: flex; justify-content: flex-end; gap: .6em; align-items: center; flex-wrap: wrap; font-size: .75em; color: #707579; margin-top: .2em; }
+.badge { background: #fde8e8; color: #b91c1c; border-radius: 1em; padding: .1em .6em; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<div>{{.Messages}} deleted messages · {{.Chat.Kind}} {{.Chat.ID}} · exported {{.Generated}}</div>
+</header>
+<main>
+{{range .Days}}
+<div class="day"><span>{{.Date}}</span></div>
+{{range .Bubbles}}
+<div class="bubble">
+{{range .IDs}}<a id="message{{.}}"></a>{{end}}
+<div class="sender c{{.Color}}">{{.Sender}}</div>
+{{if .Forward}}<div class="forward">Forwarded from {{.Forward}}</div>{{end}}
+{{if .ReplyTo}}<div class="reply">In reply to <a href="#message{{.ReplyTo}}">message {{.ReplyTo}}</a></div>{{end}}
+{{range .Media}}
+<div class="media">
+{{if .Missing}}<div class="file">📎 {{.Name}} <span class="note">({{.Missing}})</span></div>
+{{else}}
+{{if eq .Kind "image"}}<img src="{{.Src}}" alt="{{.Name}}">
+{{else if eq .Kind "video"}}<video src="{{.Src}}" controls preload="metadata"></video>
+{{else if eq .Kind "audio"}}<audio src="{{.Src}}" controls></audio>
+{{end}}
+<div class="file">📎 {{if and .Embedded (ne .Kind "file")}}{{.Name}}{{else}}<a href="{{.Src}}" download="{{.Name}}">{{.Name}}</a>{{end}} · {{.Size}}{{if not .Embedded}} <span class="note">(not embedded, kept next to the backup)</span>{{end}}{{if .Degraded}} <span class="note">(preview only)</span>{{end}}</div>
+{{end}}
+</div>
+{{end}}
+{{if .Caption}}<div class="caption">{{.Caption}}</div>{{end}}
+<div class="footer">
+<span class="badge">deleted{{if .Deleter}} by {{.Deleter}}{{end}} at {{.Deleted}}</span>
+<span>{{range $i, $id := .IDs}}{{if $i}}, {{end}}#{{$id}}{{end}} · {{.Posted}}{{if .Edited}} · edited{{end}}</span>
+</div>
+</div>
+{{end}}
+{{end}}
+</main>
+</body>
+</html>
+`))
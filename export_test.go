@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		text     string
+		entities []entityMeta
+		want     string
+	}{
+		{"a <b> & c", nil, "a &lt;b&gt; &amp; c"},
+		{
+			"bold and link",
+			[]entityMeta{{Type: "bold", Offset: 0, Length: 4}, {Type: "text_url", Offset: 9, Length: 4, URL: `https://example.com/?a="b"`}},
+			`<b>bold</b> and <a href="https://example.com/?a=&#34;b&#34;">link</a>`,
+		},
+		{"see t.me", []entityMeta{{Type: "url", Offset: 4, Length: 4}}, `see <a href="https://t.me">t.me</a>`},
+		{"click", []entityMeta{{Type: "text_url", Offset: 0, Length: 5, URL: "javascript:alert(1)"}}, "click"},
+		// Offsets count UTF-16 code units: the emoji takes two.
+		{"😀 hi", []entityMeta{{Type: "italic", Offset: 3, Length: 2}}, "😀 <i>hi</i>"},
+		{"x<y", []entityMeta{{Type: "pre", Offset: 0, Length: 3, Language: "go"}}, `<pre><code class="language-go">x&lt;y</code></pre>`},
+	}
+	for _, tt := range tests {
+		if got := renderHTML(tt.text, tt.entities); got != tt.want {
+			t.Errorf("renderHTML(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestExportHTML(t *testing.T) {
+	dir := writeTestArchive(t)
+	// A file without a preview, only linked.
+	notes := filepath.Join(dir, "@alice (111)", "notes.txt")
+	if err := os.WriteFile(notes, []byte("tx"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg := &tg.Message{ID: 8, PeerID: &tg.PeerChannel{ChannelID: 100}, Media: &tg.MessageMediaDocument{Document: &tg.Document{MimeType: "text/plain"}}}
+	meta, err := newMessageMetadata(msg, chatMeta{Kind: kindChannel.String(), ID: 100, Title: "News"}, sourceAdminLog, deletionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.File = &fileMeta{Name: "notes.txt", Size: 2, Media: "document", MimeType: "text/plain"}
+	if err := writeMetadata(notes, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(dir, "export")
+	var out bytes.Buffer
+	if code := runExport([]string{"html", "-dir", dir, "-out", outDir, "-max-embed", "3"}, &out); code != 0 {
+		t.Fatalf("export html exited with %d", code)
+	}
+	data, err := os.ReadFile(filepath.Join(outDir, "channel_100.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(data)
+	for _, want := range []string{
+		"<title>Deleted messages · News</title>",
+		"5 deleted messages",
+		`<div class="sender c`, ">@alice</div>",
+		`<div class="caption">sunset</div>`,
+		"deleted by @mod (222) at",
+		`<img src="../@alice%20%28111%29/photo.jpg"`, // Larger than -max-embed
+		`<video src="data:video/mp4;base64,bXA0"`,
+		"#2, #3", // Album in one bubble
+		// Every message of the album can be linked to.
+		`<a id="message2"></a><a id="message3"></a>`,
+		`<a href="../@alice%20%28111%29/photo.jpg" download="photo.jpg">`,
+		`<a href="data:text/plain;base64,dHg=" download="notes.txt">`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report doesn't contain %q", want)
+		}
+	}
+	// Embedded once per album item, in the player only.
+	if n := strings.Count(report, "base64,bXA0"); n != 2 {
+		t.Errorf("video data embedded %d times, want 2", n)
+	}
+	if !strings.Contains(out.String(), "5 messages of News") {
+		t.Errorf("export html printed %q", out.String())
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// FilterConfig selects which deleted messages are saved. Every criterion that
+// is set must match; the values of a list criterion are alternatives.
+type FilterConfig struct {
+	Kinds            []string `json:"kinds"`              // photo, video, voice, sticker, gif, document, text, …
+	ExcludeKinds     []string `json:"exclude_kinds"`      // Kinds that are never saved
+	MinSize          string   `json:"min_size"`           // e.g. "100KB"
+	MaxSize          string   `json:"max_size"`           // e.g. "50MB"
+	MIME             []string `json:"mime"`               // MIME type patterns, e.g. "image/*"
+	From             []int64  `json:"from"`               // Sender user IDs
+	ExcludeFrom      []int64  `json:"exclude_from"`       // Senders that are never saved
+	DeletedBy        []int64  `json:"deleted_by"`         // Deleting user IDs, admin log only
+	ExcludeDeletedBy []int64  `json:"exclude_deleted_by"` // Deleters that are never saved
+	Since            string   `json:"since"`              // Oldest message date: 2024-01-31, RFC 3339, or a duration like "24h"
+	Until            string   `json:"until"`              // Newest message date, same forms; a date includes the whole day
+}
+
+// messageFilter is the parsed form of a FilterConfig.
+type messageFilter struct {
+	kinds, excludeKinds         map[string]bool
+	minSize, maxSize            int64 // 0 means no limit
+	mime                        []string
+	from, excludeFrom           map[int64]bool
+	deletedBy, excludeDeletedBy map[int64]bool
+	since, until                time.Time
+	sinceAgo, untilAgo          time.Duration // Relative to the time of the check, for watch mode
+}
+
+// messageKinds are the accepted values of kinds and exclude_kinds, see messageKind.
+var messageKinds = []string{
+	"text", "photo", "video", "video_note", "gif", "sticker", "voice", "audio", "document",
+	"geo", "geo_live", "venue", "contact", "poll", "web_page", "dice", "game", "invoice", "story",
+	"giveaway", "giveaway_results", "paid_media",
+}
+
+// parse validates the config. It returns nil if no criterion is set.
+func (c FilterConfig) parse() (*messageFilter, error) {
+	var (
+		f   messageFilter
+		err error
+	)
+	if f.kinds, err = kindSet(c.Kinds); err != nil {
+		return nil, err
+	}
+	if f.excludeKinds, err = kindSet(c.ExcludeKinds); err != nil {
+		return nil, err
+	}
+	if f.minSize, err = parseSize(c.MinSize); err != nil {
+		return nil, fmt.Errorf("invalid min_size: %w", err)
+	}
+	if f.maxSize, err = parseSize(c.MaxSize); err != nil {
+		return nil, fmt.Errorf("invalid max_size: %w", err)
+	}
+	for _, pattern := range c.MIME {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid MIME pattern %q: %w", pattern, err)
+		}
+		f.mime = append(f.mime, pattern)
+	}
+	f.from, f.excludeFrom = idSet(c.From), idSet(c.ExcludeFrom)
+	f.deletedBy, f.excludeDeletedBy = idSet(c.DeletedBy), idSet(c.ExcludeDeletedBy)
+	if f.since, f.sinceAgo, err = parseDate(c.Since, false); err != nil {
+		return nil, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.until, f.untilAgo, err = parseDate(c.Until, true); err != nil {
+		return nil, fmt.Errorf("invalid until: %w", err)
+	}
+
+	if len(f.kinds)+len(f.excludeKinds)+len(f.mime)+len(f.from)+len(f.excludeFrom)+len(f.deletedBy)+len(f.excludeDeletedBy) == 0 &&
+		f.minSize == 0 && f.maxSize == 0 && f.since.IsZero() && f.until.IsZero() && f.sinceAgo == 0 && f.untilAgo == 0 {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func kindSet(kinds []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" {
+			continue
+		}
+		if !slices.Contains(messageKinds, k) {
+			return nil, fmt.Errorf("unknown kind %q, use one of %s", k, strings.Join(messageKinds, ", "))
+		}
+		set[k] = true
+	}
+	return set, nil
+}
+
+func idSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// parseSize parses sizes like "512", "100KB", "1.5MB" or "2GB" (powers of 1024).
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if rest, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, mult = strings.TrimSpace(rest), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size like 100KB or 50MB", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseDate parses an absolute date (2024-01-31 or RFC 3339) or a duration
+// back from now like "24h". A date without a time is the start of the day,
+// or with end set, the last instant before the next midnight, so that an
+// inclusive upper bound covers the whole day.
+func parseDate(s string, end bool) (time.Time, time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Time{}, d, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, 0, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, 0, nil
+	}
+	return time.Time{}, 0, fmt.Errorf("%q is neither a date (2024-01-31, RFC 3339) nor a duration (24h)", s)
+}
+
+// match reports whether msg passes the filter, and if not, why. deletedBy is
+// 0 when the deleting user is unknown (real-time capture); the deleter
+// criteria are ignored then.
+func (f *messageFilter) match(msg *tg.Message, deletedBy int64) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	kind := messageKind(msg)
+	if len(f.kinds) > 0 && !f.kinds[kind] {
+		return false, "kind " + kind
+	}
+	if f.excludeKinds[kind] {
+		return false, "excluded kind " + kind
+	}
+
+	// Size limits only apply to files of known size, not to text or
+	// rendered media like polls and locations.
+	size, mime := mediaSizeAndType(msg)
+	if size > 0 && f.minSize > 0 && size < f.minSize {
+		return false, fmt.Sprintf("size %d below minimum", size)
+	}
+	if size > 0 && f.maxSize > 0 && size > f.maxSize {
+		return false, fmt.Sprintf("size %d above maximum", size)
+	}
+	if len(f.mime) > 0 && !matchMIME(f.mime, mime) {
+		return false, fmt.Sprintf("MIME type %q", mime)
+	}
+
+	sender := senderID(msg)
+	if len(f.from) > 0 && !f.from[sender] {
+		return false, fmt.Sprintf("sender %d", sender)
+	}
+	if f.excludeFrom[sender] {
+		return false, fmt.Sprintf("excluded sender %d", sender)
+	}
+	if deletedBy != 0 {
+		if len(f.deletedBy) > 0 && !f.deletedBy[deletedBy] {
+			return false, fmt.Sprintf("deleted by %d", deletedBy)
+		}
+		if f.excludeDeletedBy[deletedBy] {
+			return false, fmt.Sprintf("deleted by excluded user %d", deletedBy)
+		}
+	}
+
+	date := unixTime(msg.Date)
+	since, until := f.since, f.until
+	if f.sinceAgo > 0 {
+		since = time.Now().Add(-f.sinceAgo)
+	}
+	if f.untilAgo > 0 {
+		until = time.Now().Add(-f.untilAgo)
+	}
+	if !since.IsZero() && date.Before(since) {
+		return false, "posted before " + since.Format(time.RFC3339)
+	}
+	if !until.IsZero() && date.After(until) {
+		return false, "posted after " + until.Format(time.RFC3339)
+	}
+	return true, ""
+}
+
+func matchMIME(patterns []string, mime string) bool {
+	mime = strings.ToLower(mime)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// messageKind classifies the media of msg, see messageKinds.
+func messageKind(msg *tg.Message) string {
+	switch m := msg.Media.(type) {
+	case nil:
+		return "text"
+	case *tg.MessageMediaPhoto:
+		return "photo"
+	case *tg.MessageMediaDocument:
+		doc, ok := m.Document.AsNotEmpty()
+		if !ok {
+			return "document"
+		}
+		kind := "document"
+		for _, a := range doc.Attributes {
+			switch attr := a.(type) {
+			case *tg.DocumentAttributeSticker:
+				return "sticker"
+			case *tg.DocumentAttributeAnimated:
+				return "gif"
+			case *tg.DocumentAttributeVideo:
+				if attr.RoundMessage {
+					kind = "video_note"
+				} else {
+					kind = "video"
+				}
+			case *tg.DocumentAttributeAudio:
+				if attr.Voice {
+					kind = "voice"
+				} else {
+					kind = "audio"
+				}
+			}
+		}
+		return kind
+	default:
+		return snakeCase(strings.TrimPrefix(m.TypeName(), "messageMedia"))
+	}
+}
+
+// mediaSizeAndType returns the size in bytes and the MIME type of the file of
+// msg, or zero values if it has none.
+func mediaSizeAndType(msg *tg.Message) (int64, string) {
+	switch m := msg.Media.(type) {
+	case *tg.MessageMediaPhoto:
+		photo, ok := m.Photo.AsNotEmpty()
+		if !ok {
+			return 0, ""
+		}
+		var size int64
+		for _, s := range photo.Sizes {
+			switch s := s.(type) {
+			case *tg.PhotoSize:
+				size = max64(size, int64(s.Size))
+			case *tg.PhotoSizeProgressive:
+				if n := len(s.Sizes); n > 0 {
+					size = max64(size, int64(s.Sizes[n-1]))
+				}
+			}
+		}
+		return size, "image/jpeg"
+	case *tg.MessageMediaDocument:
+		if doc, ok := m.Document.AsNotEmpty(); ok {
+			return doc.Size, doc.MimeType
+		}
+	}
+	return 0, ""
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// senderID returns the user or channel that sent msg. In private chats
+// messages of the other side may only carry the chat.
+func senderID(msg *tg.Message) int64 {
+	if key, ok := peerKeyOf(msg.FromID); ok {
+		return key.ID
+	}
+	if user, ok := msg.PeerID.(*tg.PeerUser); ok {
+		return user.UserID
+	}
+	return 0
+}
+
+// accepts applies the filter from the command line and the channel's own
+// filter to a deleted message.
+func (ch ChannelConfig) accepts(global *messageFilter, msg *tg.Message, deletedBy int64) (bool, string) {
+	if ok, why := global.match(msg, deletedBy); !ok {
+		return false, why
+	}
+	return ch.filter.match(msg, deletedBy)
+}
+
+// listFlag returns a flag.Func parser appending comma-separated values to list.
+func listFlag(list *[]string) func(string) error {
+	return func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*list = append(*list, v)
+			}
+		}
+		return nil
+	}
+}
+
+// idListFlag returns a flag.Func parser appending comma-separated IDs to list.
+func idListFlag(list *[]int64) func(string) error {
+	return func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid user ID %q", v)
+			}
+			*list = append(*list, id)
+		}
+		return nil
+	}
+}
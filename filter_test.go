@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"100KB", 100 << 10, false},
+		{"1.5mb", 3 << 19, false},
+		{" 2 GB ", 2 << 30, false},
+		{"MB", 0, true},
+		{"-1KB", 0, true},
+		{"10 TB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in      string
+		end     bool
+		want    time.Time
+		wantAgo time.Duration
+		wantErr bool
+	}{
+		{"", false, time.Time{}, 0, false},
+		{"24h", true, time.Time{}, 24 * time.Hour, false},
+		{"2024-01-31", false, time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local), 0, false},
+		// A date-only upper bound includes the whole day.
+		{"2024-01-31", true, time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond), 0, false},
+		{"2024-01-31T10:00:00Z", true, time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC), 0, false},
+		{"-24h", false, time.Time{}, 0, true},
+		{"31.01.2024", false, time.Time{}, 0, true},
+	}
+	for _, tt := range tests {
+		got, ago, err := parseDate(tt.in, tt.end)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) || ago != tt.wantAgo {
+			t.Errorf("parseDate(%q, %v) = %s, %s, %v, want %s, %s, error %v", tt.in, tt.end, got, ago, err, tt.want, tt.wantAgo, tt.wantErr)
+		}
+	}
+}
+
+func TestFilterConfigParse(t *testing.T) {
+	if f, err := (FilterConfig{Kinds: []string{" "}}).parse(); f != nil || err != nil {
+		t.Errorf("empty config parsed as %v, %v, want no filter", f, err)
+	}
+	tests := []struct {
+		name    string
+		config  FilterConfig
+		wantErr string
+	}{
+		{"kinds", FilterConfig{Kinds: []string{"Photo", " video "}, ExcludeKinds: []string{"sticker"}}, ""},
+		{"unknown kind", FilterConfig{Kinds: []string{"photos"}}, `unknown kind "photos"`},
+		{"unknown excluded kind", FilterConfig{ExcludeKinds: []string{"image"}}, `unknown kind "image"`},
+		{"sizes", FilterConfig{MinSize: "1KB", MaxSize: "50MB"}, ""},
+		{"min size", FilterConfig{MinSize: "big"}, "invalid min_size"},
+		{"max size", FilterConfig{MaxSize: "1XB"}, "invalid max_size"},
+		{"MIME", FilterConfig{MIME: []string{"image/*", "Video/MP4"}}, ""},
+		{"MIME pattern", FilterConfig{MIME: []string{"image/[jpeg"}}, "invalid MIME pattern"},
+		{"senders", FilterConfig{From: []int64{1}, ExcludeFrom: []int64{2}}, ""},
+		{"deleters", FilterConfig{DeletedBy: []int64{1}, ExcludeDeletedBy: []int64{2}}, ""},
+		{"since", FilterConfig{Since: "yesterday"}, "invalid since"},
+		{"until", FilterConfig{Until: "2024-13-01"}, "invalid until"},
+	}
+	for _, tt := range tests {
+		f, err := tt.config.parse()
+		switch {
+		case tt.wantErr == "" && (err != nil || f == nil):
+			t.Errorf("%s: parse() = %v, %v, want a filter", tt.name, f, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: parse() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMessageFilterMatch(t *testing.T) {
+	posted := time.Date(2024, 1, 31, 23, 30, 0, 0, time.Local)
+	message := func(media tg.MessageMediaClass) *tg.Message {
+		return &tg.Message{ID: 1, Date: int(posted.Unix()), FromID: &tg.PeerUser{UserID: 111}, PeerID: &tg.PeerChannel{ChannelID: 100}, Media: media}
+	}
+	document := func(size int64, mime string, attrs ...tg.DocumentAttributeClass) *tg.Message {
+		return message(&tg.MessageMediaDocument{Document: &tg.Document{ID: 1, Size: size, MimeType: mime, Attributes: attrs}})
+	}
+	var (
+		text  = message(nil)
+		photo = message(&tg.MessageMediaPhoto{Photo: &tg.Photo{ID: 1, Sizes: []tg.PhotoSizeClass{
+			&tg.PhotoSize{Type: "m", Size: 1 << 10},
+			&tg.PhotoSizeProgressive{Type: "y", Sizes: []int{1 << 10, 4 << 10}},
+		}}})
+		video   = document(10<<20, "video/mp4", &tg.DocumentAttributeVideo{})
+		voice   = document(1<<10, "audio/ogg", &tg.DocumentAttributeAudio{Voice: true})
+		unsized = document(0, "application/pdf")
+		geo     = message(&tg.MessageMediaGeo{Geo: &tg.GeoPointEmpty{}})
+	)
+
+	tests := []struct {
+		name      string
+		config    FilterConfig
+		msg       *tg.Message
+		deletedBy int64
+		want      bool
+	}{
+		{"no filter", FilterConfig{}, video, 0, true},
+		{"kind", FilterConfig{Kinds: []string{"photo", "voice"}}, voice, 0, true},
+		{"other kind", FilterConfig{Kinds: []string{"photo", "voice"}}, video, 0, false},
+		{"text kind", FilterConfig{Kinds: []string{"text"}}, text, 0, true},
+		{"media kind", FilterConfig{Kinds: []string{"geo"}}, geo, 0, true},
+		{"excluded kind", FilterConfig{ExcludeKinds: []string{"video"}}, video, 0, false},
+		{"min size", FilterConfig{MinSize: "5KB"}, photo, 0, false},
+		{"largest photo size", FilterConfig{MinSize: "4KB"}, photo, 0, true},
+		{"max size", FilterConfig{MaxSize: "5MB"}, video, 0, false},
+		{"within size", FilterConfig{MinSize: "1KB", MaxSize: "50MB"}, video, 0, true},
+		// Size limits don't apply to files of unknown size, text and
+		// rendered media.
+		{"unknown size", FilterConfig{MinSize: "1KB"}, unsized, 0, true},
+		{"text size", FilterConfig{MinSize: "1KB"}, text, 0, true},
+		{"geo size", FilterConfig{MaxSize: "1B"}, geo, 0, true},
+		{"MIME", FilterConfig{MIME: []string{"image/*"}}, photo, 0, true},
+		{"MIME case", FilterConfig{MIME: []string{"VIDEO/MP4"}}, video, 0, true},
+		{"other MIME", FilterConfig{MIME: []string{"image/*"}}, voice, 0, false},
+		{"text MIME", FilterConfig{MIME: []string{"image/*"}}, text, 0, false},
+		{"from", FilterConfig{From: []int64{111}}, text, 0, true},
+		{"other sender", FilterConfig{From: []int64{222}}, text, 0, false},
+		{"excluded sender", FilterConfig{ExcludeFrom: []int64{111}}, text, 0, false},
+		{"deleted by", FilterConfig{DeletedBy: []int64{222}}, text, 222, true},
+		{"other deleter", FilterConfig{DeletedBy: []int64{222}}, text, 333, false},
+		{"excluded deleter", FilterConfig{ExcludeDeletedBy: []int64{222}}, text, 222, false},
+		// The deleter is unknown to real-time capture.
+		{"unknown deleter", FilterConfig{DeletedBy: []int64{222}, ExcludeDeletedBy: []int64{333}}, text, 0, true},
+		{"since", FilterConfig{Since: "2024-01-31"}, text, 0, true},
+		{"since later day", FilterConfig{Since: "2024-02-01"}, text, 0, false},
+		{"until same day", FilterConfig{Until: "2024-01-31"}, text, 0, true},
+		{"until earlier day", FilterConfig{Until: "2024-01-30"}, text, 0, false},
+		{"until time", FilterConfig{Until: posted.Add(-time.Minute).Format(time.RFC3339)}, text, 0, false},
+		{"since duration", FilterConfig{Since: "24h"}, text, 0, false},
+		{"until duration", FilterConfig{Until: "24h"}, text, 0, true},
+	}
+	for _, tt := range tests {
+		f, err := tt.config.parse()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, why := f.match(tt.msg, tt.deletedBy); got != tt.want {
+			t.Errorf("%s: match() = %v (%s), want %v", tt.name, got, why, tt.want)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// defaultPathTemplate is the original layout: a folder per sender, albums
+// in a folder of their own, files prefixed with the message date.
+const defaultPathTemplate = "{sender}/{album}/{file}"
+
+// defaultAlbumPathTemplate lays out album items with the default layout:
+// inside the album folder they are ordered by message ID instead of date.
+const defaultAlbumPathTemplate = "{sender}/{album}/{msg_id}_{filename}"
+
+// defaultLayout and defaultAlbumLayout are the parsed default templates.
+var (
+	defaultLayout      = mustParsePathTemplate(defaultPathTemplate)
+	defaultAlbumLayout = mustParsePathTemplate(defaultAlbumPathTemplate)
+)
+
+func mustParsePathTemplate(s string) *pathTemplate {
+	t, err := parsePathTemplate(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// defaultDateLayout formats {date} and {deleted} without an explicit layout.
+const defaultDateLayout = "20060102_150405"
+
+// pathVariables are the names accepted in a path template.
+var pathVariables = []string{
+	"channel", "channel_id",
+	"sender", "sender_id", "sender_username",
+	"deleter",
+	"type", "album", "album_id", "msg_id",
+	"filename", "file",
+	"date", "deleted",
+}
+
+// dateVariables are the variables taking a Go time layout, e.g. {date:2006/01}.
+var dateVariables = []string{"date", "deleted"}
+
+// pathTemplate is a parsed output path template like
+// "{channel}/{date:2006/01}/{sender_username}/{msg_id}_{filename}".
+// Paths are relative to the output directory.
+type pathTemplate struct {
+	raw       string
+	tokens    []pathToken
+	fileStart int // First token of the last path segment, which names the file
+}
+
+// pathToken is literal text or a variable of a path template.
+type pathToken struct {
+	literal string
+	name    string // Variable name, empty for literal text
+	layout  string // Time layout of date variables
+}
+
+// parsePathTemplate validates a path template. The last path segment must
+// contain {file} or {filename}, so every message gets a file name of its own.
+func parsePathTemplate(s string) (*pathTemplate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty path template")
+	}
+	if strings.HasPrefix(s, "/") || filepath.IsAbs(s) {
+		return nil, fmt.Errorf("path template %q must be relative to the output directory", s)
+	}
+
+	t := &pathTemplate{raw: s}
+	hasFile := false // In the current segment
+	for rest := s; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			open = len(rest)
+		}
+		if literal := rest[:open]; literal != "" {
+			if strings.ContainsRune(literal, '}') {
+				return nil, fmt.Errorf("unbalanced } in path template %q", s)
+			}
+			for i, part := range strings.Split(literal, "/") {
+				if part == "." || part == ".." {
+					return nil, fmt.Errorf("path template %q must not contain . or .. segments", s)
+				}
+				if i > 0 {
+					hasFile, t.fileStart = false, len(t.tokens)
+				}
+			}
+			t.tokens = append(t.tokens, pathToken{literal: literal})
+		}
+		if open == len(rest) {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated { in path template %q", s)
+		}
+		name, layout, hasLayout := strings.Cut(rest[open+1:open+end], ":")
+		if !slices.Contains(pathVariables, name) {
+			return nil, fmt.Errorf("unknown variable {%s} in path template, use one of %s", name, strings.Join(pathVariables, ", "))
+		}
+		if hasLayout && !slices.Contains(dateVariables, name) {
+			return nil, fmt.Errorf("variable {%s} takes no format", name)
+		}
+		if hasLayout && layout == "" {
+			return nil, fmt.Errorf("empty date format in {%s:}", name)
+		}
+		if slices.Contains(dateVariables, name) && strings.Contains(layout, "/") {
+			hasFile, t.fileStart = false, len(t.tokens)
+		}
+		if name == "file" || name == "filename" {
+			hasFile = true
+		}
+		t.tokens = append(t.tokens, pathToken{name: name, layout: layout})
+		rest = rest[open+end+1:]
+	}
+	if !hasFile {
+		return nil, fmt.Errorf("the last segment of path template %q must contain {file} or {filename}", s)
+	}
+	return t, nil
+}
+
+func (t *pathTemplate) String() string {
+	return t.raw
+}
+
+// forMessage returns the layout of msg. The default layout names album
+// items after their message ID, see defaultAlbumPathTemplate; any other
+// template applies to album items as it is.
+func (t *pathTemplate) forMessage(msg *tg.Message) *pathTemplate {
+	if t == nil {
+		t = defaultLayout
+	}
+	if msg.GroupedID != 0 && t.raw == defaultPathTemplate {
+		return defaultAlbumLayout
+	}
+	return t
+}
+
+// inDir reports whether one of the variables names a directory, e.g. {album}
+// in "{sender}/{album}/{file}".
+func (t *pathTemplate) inDir(names ...string) bool {
+	for _, tok := range t.tokens[:t.fileStart] {
+		if tok.name != "" && slices.Contains(names, tok.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathVars are the values a template is expanded with, see pathVarsOf.
+type pathVars struct {
+	values        map[string]string
+	date, deleted time.Time
+	dirs          map[string]entityDir // Variables naming an entity's directory
+}
+
+// entityDir identifies the directory of a user or chat, see stableDirName.
+type entityDir struct {
+	plain string // Name used without a known name, the user ID for users
+	id    int64
+}
+
+// fallback replaces the value of a variable that sanitizes to nothing, e.g.
+// the title of a channel named "...". It's the variable name and the ID of
+// the chat, user or message, so the files of a channel or sender still share
+// one directory across runs.
+func (v pathVars) fallback(name string) string {
+	var id string
+	switch name {
+	case "":
+		return "_" // Literal dots next to empty variables
+	case "channel":
+		id = v.values["channel_id"]
+	case "sender", "sender_username", "deleter":
+		if dir, ok := v.dirs[strings.TrimSuffix(name, "_username")]; ok {
+			id = strconv.FormatInt(dir.id, 10)
+		}
+	default:
+		id = v.values["msg_id"]
+	}
+	if id == "" {
+		return name
+	}
+	return name + "_" + id
+}
+
+// expand returns the relative path of a file inside root. Every expanded
+// value is sanitized, so it can't add directories of its own; only the
+// slashes of the template and of date layouts separate directories.
+// Segments that expand to nothing, like {album} outside albums, are dropped.
+// A segment made of {sender} or {deleter} alone reuses the existing
+// directory of the entity, see stableDirName.
+func (t *pathTemplate) expand(root string, v pathVars) string {
+	var (
+		segments []string
+		current  strings.Builder
+		only     string // The variable if it's all of the current segment
+		parts    int    // Tokens in the current segment
+	)
+	next := func() {
+		segment := strings.TrimSpace(current.String())
+		if segment != "" {
+			if segment = sanitizeName(segment); segment == "" {
+				segment = v.fallback(only)
+			}
+			if dir, ok := v.dirs[only]; ok && parts == 1 && root != "" {
+				parent := filepath.Join(append([]string{root}, segments...)...)
+				segment = stableDirName(parent, segment, dir.plain, dir.id)
+			}
+			segments = append(segments, segment)
+		}
+		current.Reset()
+		only, parts = "", 0
+	}
+	write := func(name, text string) {
+		for i, part := range strings.Split(text, "/") {
+			if i > 0 {
+				next()
+			}
+			if part != "" {
+				current.WriteString(part)
+				only, parts = name, parts+1
+			}
+		}
+	}
+
+	for _, tok := range t.tokens {
+		switch {
+		case tok.name == "":
+			write("", tok.literal)
+		case slices.Contains(dateVariables, tok.name):
+			date := v.date
+			if tok.name == "deleted" {
+				date = v.deleted
+			}
+			layout := tok.layout
+			if layout == "" {
+				layout = defaultDateLayout
+			}
+			parts := strings.Split(date.Format(layout), "/")
+			for i, part := range parts {
+				if part != "" {
+					parts[i] = sanitize(part)
+				}
+			}
+			write(tok.name, strings.Join(parts, "/"))
+		default:
+			if value := v.values[tok.name]; value != "" {
+				if value = sanitizeName(value); value == "" {
+					value = v.fallback(tok.name)
+				}
+				write(tok.name, value)
+			}
+		}
+	}
+	next()
+	return filepath.Join(segments...)
+}
+
+// mediaDest describes where the media of one deleted message is saved.
+type mediaDest struct {
+	dir      string        // Output directory
+	layout   *pathTemplate // Layout inside dir, nil for the default
+	chat     chatMeta
+	deletion deletionMeta // Zero while the message isn't deleted yet
+	names    *entityCache // Names of senders and deleters, may be nil
+}
+
+// pathLayout returns the layout of the channel: its own path_template, the
+// -path-template flag or the default.
+func (ch ChannelConfig) pathLayout(global *pathTemplate) *pathTemplate {
+	if ch.layout != nil {
+		return ch.layout
+	}
+	return global
+}
+
+// adminLogDest returns where the media of a message deleted in ev is saved.
+// global is the layout from the command line.
+func (ch ChannelConfig) adminLogDest(global *pathTemplate, chat chatMeta, ev tg.ChannelAdminLogEvent) mediaDest {
+	return mediaDest{
+		dir:      ch.OutputDir,
+		layout:   ch.pathLayout(global),
+		chat:     chat,
+		deletion: adminLogDeletion(ev),
+		names:    entitiesFor(ch.OutputDir),
+	}
+}
+
+// senderDirName names the sender of a message whose name isn't known: the
+// sender's user ID, or the chat if the sender is unknown.
+func senderDirName(msg *tg.Message) string {
+	if from, ok := msg.FromID.(*tg.PeerUser); ok {
+		return strconv.FormatInt(from.UserID, 10)
+	}
+	switch peer := msg.PeerID.(type) {
+	case *tg.PeerUser: // Private chats may omit from_id
+		return strconv.FormatInt(peer.UserID, 10)
+	case *tg.PeerChat:
+		return fmt.Sprintf("chat_%d", peer.ChatID)
+	case *tg.PeerChannel:
+		return fmt.Sprintf("channel_%d", peer.ChannelID)
+	default:
+		return "unknown_sender"
+	}
+}
+
+// pathVarsOf collects the template values of msg. file is the default,
+// timestamped file name and filename the original or generated one.
+func pathVarsOf(msg *tg.Message, dest mediaDest, filename, file string) pathVars {
+	sender := senderDirName(msg)
+	dirs := make(map[string]entityDir)
+	fromID, username := "", ""
+	if key, ok := senderKeyOf(msg); ok {
+		dirs["sender"] = entityDir{plain: sender, id: key.ID}
+		if e, ok := dest.names.lookup(key); ok && (e.Username != "" || e.Name != "") {
+			sender, username = e.label(), e.Username
+		}
+	}
+	if id := senderID(msg); id != 0 {
+		fromID = strconv.FormatInt(id, 10)
+	}
+	if username == "" {
+		username = sender
+	}
+	channel := dest.chat.Title
+	if channel == "" {
+		channel = dest.chat.Ref
+	}
+	if channel == "" && dest.chat.ID != 0 {
+		channel = fmt.Sprintf("%s_%d", dest.chat.Kind, dest.chat.ID)
+	}
+	deleter := "unknown"
+	if id := dest.deletion.DeletedBy; id != 0 {
+		deleter = strconv.FormatInt(id, 10)
+		dirs["deleter"] = entityDir{plain: deleter, id: id}
+		if e, ok := dest.names.user(id); ok && (e.Username != "" || e.Name != "") {
+			deleter = e.label()
+		}
+	}
+	album, albumID := "", ""
+	if msg.GroupedID != 0 {
+		album, albumID = albumDirName(msg.GroupedID), strconv.FormatInt(msg.GroupedID, 10)
+	}
+	channelID := ""
+	if dest.chat.ID != 0 {
+		channelID = strconv.FormatInt(dest.chat.ID, 10)
+	}
+	deleted := dest.deletion.DeletedAt
+	if deleted.IsZero() {
+		deleted = time.Now()
+	}
+
+	return pathVars{
+		values: map[string]string{
+			"channel":         channel,
+			"channel_id":      channelID,
+			"sender":          sender,
+			"sender_id":       fromID,
+			"sender_username": username,
+			"deleter":         deleter,
+			"type":            messageKind(msg),
+			"album":           album,
+			"album_id":        albumID,
+			"msg_id":          strconv.Itoa(msg.ID),
+			"filename":        filename,
+			"file":            file,
+		},
+		date:    time.Unix(int64(msg.Date), 0), // Local time, like the timestamp of {file}
+		deleted: deleted.Local(),
+		dirs:    dirs,
+	}
+}
+
+// senderKeyOf returns the peer that sent msg: the user, or the chat for
+// anonymous posts.
+func senderKeyOf(msg *tg.Message) (peerKey, bool) {
+	if key, ok := peerKeyOf(msg.FromID); ok {
+		return key, true
+	}
+	return peerKeyOf(msg.PeerID)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+func TestPathTemplate(t *testing.T) {
+	vars := pathVars{
+		values: map[string]string{
+			"channel":         "News: daily",
+			"sender":          "111111111",
+			"sender_username": "alice",
+			"msg_id":          "4211",
+			"filename":        "photo.jpg",
+			"file":            "20240501_123000_photo.jpg",
+		},
+		date:    time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		deleted: time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		template string
+		want     string
+		album    bool // {album} or {album_id} names a directory
+	}{
+		{template: defaultPathTemplate, want: "111111111/20240501_123000_photo.jpg", album: true},
+		{template: "{channel}/{date:2006/01}/{sender_username}/{msg_id}_{filename}", want: "News_ daily/2024/05/alice/4211_photo.jpg"},
+		{template: "{deleted:2006-01-02}/{album_id}/{file}", want: "2024-05-02/20240501_123000_photo.jpg", album: true},
+		{template: "{album_id}_{file}", want: "_20240501_123000_photo.jpg"},
+		{template: "by/{sender}/{date}_{filename}", want: "by/111111111/20240501_123000_photo.jpg"},
+	}
+	for _, tt := range tests {
+		tmpl, err := parsePathTemplate(tt.template)
+		if err != nil {
+			t.Errorf("parsePathTemplate(%q) failed: %v", tt.template, err)
+			continue
+		}
+		if got := tmpl.expand("", vars); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%q expanded to %q, want %q", tt.template, got, tt.want)
+		}
+		if got := tmpl.inDir("album", "album_id"); got != tt.album {
+			t.Errorf("%q: inDir(album) = %v, want %v", tt.template, got, tt.album)
+		}
+	}
+}
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"/abs/{file}",
+		"{sender}",
+		"{file}/{sender}",
+		"{date:2006/01}",
+		"{unknown}/{file}",
+		"{sender:x}/{file}",
+		"{date:}/{file}",
+		"../{file}",
+		"{sender}/./{file}",
+		"{sender/{file}",
+		"sender}/{file}",
+	} {
+		if _, err := parsePathTemplate(s); err == nil {
+			t.Errorf("parsePathTemplate(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestExpandReusesEntityDir(t *testing.T) {
+	root := t.TempDir()
+	tmpl, err := parsePathTemplate("{sender}/{file}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := func(sender string) pathVars {
+		return pathVars{
+			values: map[string]string{"sender": sender, "file": "a.jpg"},
+			dirs:   map[string]entityDir{"sender": {plain: "111", id: 111}},
+		}
+	}
+
+	if got := tmpl.expand(root, vars("@alice (111)")); got != filepath.Join("@alice (111)", "a.jpg") {
+		t.Errorf("new sender expanded to %q", got)
+	}
+	if err := os.Mkdir(filepath.Join(root, "Alice Smith (111)"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.expand(root, vars("@alice (111)")); got != filepath.Join("Alice Smith (111)", "a.jpg") {
+		t.Errorf("renamed sender expanded to %q, want the existing directory", got)
+	}
+	if err := os.Mkdir(filepath.Join(root, "111"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.expand(root, vars("@alice (111)")); got != filepath.Join("111", "a.jpg") {
+		t.Errorf("sender expanded to %q, want the ID directory", got)
+	}
+}
+
+func TestLayoutForAlbums(t *testing.T) {
+	custom, err := parsePathTemplate("{channel}/{album_id}/{file}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := chatMeta{Kind: kindChannel.String(), ID: 100, Title: "News"}
+	msg := &tg.Message{
+		ID:        4211,
+		GroupedID: 77,
+		Date:      int(time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local).Unix()),
+		FromID:    &tg.PeerUser{UserID: 111111111},
+		PeerID:    &tg.PeerChannel{ChannelID: 100},
+		Media:     &tg.MessageMediaPhoto{Photo: &tg.Photo{ID: 1, Sizes: []tg.PhotoSizeClass{&tg.PhotoSize{Type: "y", W: 10, H: 10, Size: 1}}}},
+	}
+	tests := []struct {
+		layout *pathTemplate
+		want   string
+	}{
+		{nil, "111111111/album_77/4211_1_y.jpg"},
+		{defaultLayout, "111111111/album_77/4211_1_y.jpg"},
+		{custom, "News/77/20240501_123000_1_y.jpg"}, // {file} is the same for album items
+	}
+	for _, tt := range tests {
+		target, err := newMediaTarget(msg, mediaDest{layout: tt.layout, chat: chat}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target.destPath != filepath.FromSlash(tt.want) {
+			t.Errorf("%v: album item saved to %q, want %q", tt.layout, target.destPath, tt.want)
+		}
+		if !target.album {
+			t.Errorf("%v: album item not in its album folder", tt.layout)
+		}
+	}
+}
+
+func TestExpandDotNames(t *testing.T) {
+	tmpl, err := parsePathTemplate("{channel}/{sender}/{deleter}/{msg_id}_{filename}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := pathVars{
+		values: map[string]string{
+			"channel":    "...",
+			"channel_id": "100",
+			"sender":     " . ",
+			"deleter":    "..",
+			"msg_id":     "4211",
+			"filename":   "...",
+		},
+		dirs: map[string]entityDir{
+			"sender":  {plain: "111", id: 111},
+			"deleter": {plain: "222", id: 222},
+		},
+	}
+	// The same names on every run, so a channel titled "..." keeps one
+	// directory.
+	want := filepath.FromSlash("channel_100/sender_111/deleter_222/4211_filename_4211")
+	for range 2 {
+		if got := tmpl.expand("", vars); got != want {
+			t.Errorf("dot names expanded to %q, want %q", got, want)
+		}
+	}
+
+	doc := &tg.Document{ID: 5, MimeType: "audio/ogg", Attributes: []tg.DocumentAttributeClass{&tg.DocumentAttributeFilename{FileName: ".."}}}
+	if got := filenameFromDocument(doc, zap.NewNop()); got != "5.ogg" {
+		t.Errorf("file name of %q = %q, want the generated name", "..", got)
+	}
+}
@@ -4,34 +4,151 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv" // Still needed for conversion
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/telegram/auth"
-	"github.com/gotd/td/telegram/downloader"
+	"github.com/gotd/td/telegram/updates"
 	"github.com/gotd/td/tg"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/joho/godotenv" // Import godotenv
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore" // Import for log level configuration
 )
 
+// runOptions holds command line options that apply to every channel.
+type runOptions struct {
+	Full        bool           // Ignore saved cursors and walk the whole admin log
+	Concurrency int            // Parallel downloads
+	Retries     int            // Retries of transient download errors
+	Thumbnails  bool           // Also save thumbnails and embedded previews
+	Dedup       linkMode       // How duplicate downloads are linked to the content store
+	Catalog     bool           // Record events, messages and files in catalog.db
+	Layout      *pathTemplate  // Where files are saved inside the output directory
+	Filter      *messageFilter // Which deleted messages are saved, nil saves everything
+
+	DryRun bool // Only report what would be saved
+	JSON   bool // Print the dry run report as JSON
+
+	Watch    bool          // Keep running and poll the admin log
+	Interval time.Duration // Default poll interval in watch mode
+
+	Realtime  bool          // Capture messages from updates in watch mode
+	Eager     bool          // Download media of new messages before they are deleted
+	CacheTTL  time.Duration // How long new messages are remembered
+	CacheSize int           // Maximum number of remembered messages
+	History   int           // Recent messages per chat remembered at startup
+}
+
 func main() {
-	ctx := context.Background()
+	// Cancel the context on Ctrl+C / SIGTERM so running scans can stop cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// --- Parse Command Line ---
+	// The first argument selects the command, "backup" is used if it's omitted.
+	command, args := "backup", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if slices.Contains(queryCommands, command) {
+		os.Exit(runQuery(command, args, os.Stdout))
+	}
+	switch command {
+	case "serve":
+		os.Exit(runServe(ctx, args))
+	case "export":
+		os.Exit(runExport(args, os.Stdout))
+	}
+	var (
+		opts runOptions
+		err  error
+	)
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.BoolVar(&opts.Full, "full", false, "walk the whole admin log, ignoring the saved cursor")
+	fs.IntVar(&opts.Concurrency, "concurrency", 4, "number of files downloaded in parallel")
+	fs.IntVar(&opts.Retries, "retries", 5, "how often a failed download is retried on network or server errors")
+	fs.BoolVar(&opts.Thumbnails, "thumbnails", false, "also save thumbnails, video previews and other photo sizes")
+	pathTemplate := fs.String("path-template", defaultPathTemplate, "layout of saved files inside the output directory, e.g. {channel}/{date:2006/01}/{sender_username}/{msg_id}_{filename}")
+	dedup := fs.String("dedup", "off", "store each downloaded file once and link reposts to it: hardlink, symlink or off")
+	fs.BoolVar(&opts.Catalog, "catalog", false, "record admin log events and recovered messages and files in catalog.db in the output directory")
+	var filter FilterConfig
+	fs.Func("kinds", "only save these comma-separated kinds: "+strings.Join(messageKinds, ", "), listFlag(&filter.Kinds))
+	fs.Func("exclude-kinds", "never save these comma-separated kinds", listFlag(&filter.ExcludeKinds))
+	fs.StringVar(&filter.MinSize, "min-size", "", "only save files of at least this size, e.g. 100KB")
+	fs.StringVar(&filter.MaxSize, "max-size", "", "only save files of at most this size, e.g. 50MB")
+	fs.Func("mime", "only save files with these comma-separated MIME types, e.g. image/*,video/mp4", listFlag(&filter.MIME))
+	fs.Func("from", "only save messages sent by these comma-separated user IDs", idListFlag(&filter.From))
+	fs.Func("exclude-from", "never save messages sent by these comma-separated user IDs", idListFlag(&filter.ExcludeFrom))
+	fs.Func("deleted-by", "only save messages deleted by these comma-separated user IDs", idListFlag(&filter.DeletedBy))
+	fs.Func("exclude-deleted-by", "never save messages deleted by these comma-separated user IDs", idListFlag(&filter.ExcludeDeletedBy))
+	fs.StringVar(&filter.Since, "since", "", "only save messages posted after this date (2024-01-31, RFC 3339) or within this duration (24h)")
+	fs.StringVar(&filter.Until, "until", "", "only save messages posted before this date or duration")
+	switch command {
+	case "backup":
+		fs.BoolVar(&opts.DryRun, "dry-run", false, "only list the deleted messages that would be saved, without downloading or writing anything")
+		fs.BoolVar(&opts.JSON, "json", false, "with -dry-run, print the report as JSON")
+	case "watch":
+		opts.Watch = true
+		fs.DurationVar(&opts.Interval, "interval", time.Minute, "how often to poll the admin log of each channel")
+		fs.BoolVar(&opts.Realtime, "realtime", false, "also follow new messages via updates and save media of deleted ones")
+		fs.BoolVar(&opts.Eager, "eager", false, "with -realtime, download media as soon as a message arrives")
+		fs.DurationVar(&opts.CacheTTL, "cache-ttl", 48*time.Hour, "with -realtime, how long new messages are remembered")
+		fs.IntVar(&opts.CacheSize, "cache-size", 10000, "with -realtime, maximum number of remembered messages")
+		fs.IntVar(&opts.History, "history", 100, "with -realtime, number of recent messages per chat remembered at startup")
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Available commands: backup, watch, serve, export, %s\n", command, strings.Join(queryCommands, ", "))
+		os.Exit(2)
+	}
+	_ = fs.Parse(args) // ExitOnError handles failures
+	if opts.Concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "-concurrency must be positive")
+		os.Exit(2)
+	}
+	if opts.Retries < 0 {
+		fmt.Fprintln(os.Stderr, "-retries must not be negative")
+		os.Exit(2)
+	}
+	if opts.Layout, err = parsePathTemplate(*pathTemplate); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -path-template: %v\n", err)
+		os.Exit(2)
+	}
+	if opts.Dedup, err = parseLinkMode(*dedup); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -dedup: %v\n", err)
+		os.Exit(2)
+	}
+	if opts.Filter, err = filter.parse(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid filter: %v\n", err)
+		os.Exit(2)
+	}
+	if opts.Watch && opts.Interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval must be positive")
+		os.Exit(2)
+	}
+	if opts.Realtime && (opts.CacheTTL <= 0 || opts.CacheSize <= 0) {
+		fmt.Fprintln(os.Stderr, "-cache-ttl and -cache-size must be positive")
+		os.Exit(2)
+	}
+	// --- End Command Line ---
 
 	// --- Load Environment Variables ---
 	// Load .env file from the current directory.
 	// It's often okay if it doesn't exist, environment variables might be set directly.
-	err := godotenv.Load()
+	err = godotenv.Load()
 	if err != nil {
 		// Log a warning instead of failing if .env is not found.
 		// You might have set the env vars externally (e.g., Docker, system).
-		fmt.Printf("Warning: Could not load .env file: %v. Relying on system environment variables.\n", err)
+		fmt.Fprintf(os.Stderr, "Warning: Could not load .env file: %v. Relying on system environment variables.\n", err)
 	}
 
 	// --- Configure Logger ---
@@ -42,7 +159,7 @@ func main() {
 		if err == nil {
 			logLevel = parsedLevel
 		} else {
-			fmt.Printf("Warning: Invalid LOG_LEVEL '%s' in environment, using default 'INFO'. Error: %v\n", envLogLevel, err)
+			fmt.Fprintf(os.Stderr, "Warning: Invalid LOG_LEVEL '%s' in environment, using default 'INFO'. Error: %v\n", envLogLevel, err)
 		}
 	}
 
@@ -71,25 +188,50 @@ func main() {
 		log.Fatal("API_HASH not found in environment variables or .env file. Please set it.")
 	}
 
-	channelIDStr := os.Getenv("CHANNEL_ID")
-	if channelIDStr == "" {
-		log.Fatal("CHANNEL_ID not found in environment variables or .env file. Please set it.")
-	}
-	channelID, err := strconv.ParseInt(channelIDStr, 10, 64)
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatal("Invalid CHANNEL_ID format in environment (must be an integer)", zap.String("value", channelIDStr), zap.Error(err))
+		log.Fatal("Failed to load configuration", zap.Error(err))
 	}
+	log.Info("Loaded configuration", zap.Int("channels", len(cfg.Channels)))
 	// --- End Configuration ---
 
+	// Downloads interrupted by a crash or kill leave .part files behind. Recent
+	// ones are resumed when the media is downloaded again, old ones are removed.
+	cleaned := make(map[string]bool)
+	for _, ch := range cfg.Channels {
+		if opts.DryRun || cleaned[ch.OutputDir] {
+			continue
+		}
+		cleaned[ch.OutputDir] = true
+		if err := removePartials(ch.OutputDir, partialMaxAge, log); err != nil {
+			log.Warn("Failed to remove incomplete downloads", zap.Error(err))
+		}
+	}
+
 	// Session file keeps you logged-in between runs.
 	session := filepath.Join(os.TempDir(), "tg.session")
 	log.Info("Using session file", zap.String("path", session))
 
 	// Build Telegram client using credentials from environment.
-	client := telegram.NewClient(apiID, apiHash, telegram.Options{
+	clientOpts := telegram.Options{
 		Logger:         log,
 		SessionStorage: &telegram.FileSessionStorage{Path: session},
-	})
+	}
+
+	// In real-time mode updates go through the gap manager so none are missed,
+	// and are then routed to the capture handlers by the dispatcher.
+	var (
+		dispatcher = tg.NewUpdateDispatcher()
+		gaps       *updates.Manager
+	)
+	if opts.Realtime {
+		gaps = updates.New(updates.Config{
+			Handler: dispatcher,
+			Logger:  log.Named("updates"),
+		})
+		clientOpts.UpdateHandler = gaps
+	}
+	client := telegram.NewClient(apiID, apiHash, clientOpts)
 
 	// Authentication flow handles authentication process, like prompting for code and 2FA password.
 	// Terminal still uses readUserInput for interactive auth steps.
@@ -102,189 +244,340 @@ func main() {
 		}
 		log.Info("Authentication successful.")
 
-		// Use the channel ID from environment
-		log.Info("Getting channel information...", zap.Int64("channel_id", channelID))
-		list, err := client.API().ChannelsGetChannels(ctx, []tg.InputChannelClass{&tg.InputChannel{ChannelID: channelID, AccessHash: 0}})
-		if err != nil {
-			// Provide more context on potential channel ID issues
-			if strings.Contains(err.Error(), "CHANNEL_INVALID") || strings.Contains(err.Error(), "PEER_ID_INVALID") {
-				return fmt.Errorf("failed to get channel info (ID: %d). Error: %w. Please ensure the Channel ID in your .env/environment is correct and the bot/user is a member (or admin) of the channel", channelID, err)
-			}
-			return fmt.Errorf("ChannelsGetChannels request failed (ID: %d): %w", channelID, err)
+		if opts.DryRun {
+			return dryRunAll(ctx, client, cfg.Channels, opts, os.Stdout, log)
 		}
 
-		if len(list.GetChats()) == 0 {
-			return fmt.Errorf("no channel found for the provided ID: %d (from .env/environment). Ensure the ID is correct and your account is a member", channelID)
-		}
+		// Prepare downloader once, it is shared by all channels.
+		f := newFetcher(client, opts.Concurrency, opts.Retries, opts.Dedup, opts.Catalog, log)
+		defer f.close()
+		defer f.closeStores()
+		defer f.closeCatalogs()
 
-		channelInfo, ok := list.GetChats()[0].(*tg.Channel)
-		if !ok {
-			// Could be a tg.Chat, tg.ChatForbidden etc.
-			chat := list.GetChats()[0]
-			chatType := fmt.Sprintf("%T", chat) // Get the type
-			if forbidden, isForbidden := chat.(*tg.ChannelForbidden); isForbidden {
-				return fmt.Errorf("access to channel %d is forbidden until %s. Reason: %s", forbidden.ID, time.Unix(int64(forbidden.UntilDate), 0).Format(time.RFC3339), forbidden.Title)
-			}
-			return fmt.Errorf("the provided ID %d does not belong to an accessible Channel (supergroup/channel). Found type: %s", channelID, chatType)
+		if !opts.Watch {
+			return scanAll(ctx, client, f, cfg.Channels, opts, log)
 		}
-
-		log.Info("Successfully found channel", zap.String("title", channelInfo.Title), zap.Int64("id", channelInfo.ID), zap.Int64("access_hash", channelInfo.AccessHash))
-
-		// Prepare downloader once.
-		dl := downloader.NewDownloader()
-
-		// Iterate over log in 100-event pages.
-		var (
-			maxID int64 // start from 0 = newest
-			total int   // Keep track of saved files
-		)
-		log.Info("Fetching admin log for deleted messages...")
-		for {
-			req := &tg.ChannelsGetAdminLogRequest{
-				Channel: &tg.InputChannel{
-					ChannelID:  channelID,
-					AccessHash: channelInfo.AccessHash,
-				},
-				EventsFilter: tg.ChannelAdminLogEventsFilter{
-					Delete: true,
-				},
-				Limit: 100,
-				MaxID: maxID,
-			}
-
-			log.Debug("Requesting admin log page", zap.Int64("max_id", maxID))
-			res, err := client.API().ChannelsGetAdminLog(ctx, req)
-			if err != nil {
-				return fmt.Errorf("failed to execute GetAdminLog request: %w", err)
-			}
-
-			log.Debug("Fetched admin log page", zap.Int("event_count", len(res.Events)), zap.Int("user_count", len(res.Users)), zap.Int("chat_count", len(res.Chats)))
-
-			if len(res.Events) == 0 {
-				log.Info("Reached end of admin log for delete events.")
-				break // no more pages
-			}
-
-			foundDeletedMedia := false
-			for _, ev := range res.Events {
-				maxID = ev.ID // Update maxID for the next page request (important to do for every event)
-				// We only care about delete-message events.
-				if del, ok := ev.Action.(*tg.ChannelAdminLogEventActionDeleteMessage); ok {
-					// del.Message can be *tg.Message, *tg.MessageService…
-					if msg, ok := del.Message.(*tg.Message); ok && msg.Media != nil {
-						foundDeletedMedia = true
-						log.Info("Found deleted message with media", zap.Int("msg_id", msg.ID), zap.Time("date", time.Unix(int64(msg.Date), 0)))
-						if err := saveMedia(ctx, client, dl, msg, log); err != nil {
-							// Log warning but continue processing other messages
-							log.Warn("Failed to save media", zap.Int("msg_id", msg.ID), zap.Error(err))
-						} else if err == nil { // Explicitly check for nil error if saveMedia returns nil for skipped unsupported media
-							total++ // Increment counter only on successful save (or skipped)
-							log.Info("Successfully processed/saved media for message", zap.Int("msg_id", msg.ID))
-						}
-					} else if msgService, ok := del.Message.(*tg.MessageService); ok {
-						log.Debug("Found deleted service message", zap.Int("msg_id", msgService.ID))
-					}
-				} else {
-					log.Debug("Skipping non-delete admin log event", zap.String("type", fmt.Sprintf("%T", ev.Action)))
-				}
-			}
-
-			if !foundDeletedMedia && len(res.Events) > 0 {
-				log.Debug("Processed admin log batch, but no deleted messages *with media* were found in this batch.")
-			}
-
-			// Optional: Add a small delay to avoid hitting rate limits, although GetAdminLog is usually less sensitive.
-			// log.Debug("Sleeping briefly before next request...")
-			// time.Sleep(500 * time.Millisecond)
+		if !opts.Realtime {
+			return watchChannels(ctx, client, f, cfg.Channels, nil, opts, log)
 		}
 
-		log.Info("Finished processing admin log.", zap.Int("total_files_potentially_saved", total))
-		return nil
+		self, err := client.Self(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get current user: %w", err)
+		}
+		capture := newRealtimeCapture(client, f, opts, log.Named("realtime"))
+		capture.register(dispatcher)
+
+		g, ctx := errgroup.WithContext(ctx)
+		g.Go(func() error {
+			return gaps.Run(ctx, client.API(), self.ID, updates.AuthOptions{
+				OnStart: func(ctx context.Context) {
+					log.Info("Listening for updates.")
+				},
+			})
+		})
+		g.Go(func() error {
+			return capture.run(ctx)
+		})
+		g.Go(func() error {
+			return watchChannels(ctx, client, f, cfg.Channels, capture, opts, log)
+		})
+		return g.Wait()
 	}); err != nil {
+		if ctx.Err() != nil {
+			log.Info("Stopped by signal.")
+			return
+		}
 		// Use Fatal to exit after logging the error
 		log.Fatal("Application run failed", zap.Error(err))
 	}
 }
 
-// saveMedia downloads media contained in msg and stores it in ./media_backup/.
+// saveMedia downloads media contained in msg and stores it at dest.
+// refresh is optional and used to get a fresh file reference if it expired.
+// meta is optional and written as the sidecar of the saved file.
 // Added logger as argument for more contextual logging.
-func saveMedia(ctx context.Context, client *telegram.Client, dl *downloader.Downloader, msg *tg.Message, log *zap.Logger) error {
-	loc, filename, err := inputLocation(msg, log) // Pass logger
+func saveMedia(ctx context.Context, f *fetcher, msg *tg.Message, dest mediaDest, refresh refreshFunc, meta *messageMetadata, log *zap.Logger) error {
+	target, err := newMediaTarget(msg, dest, log)
 	if err != nil {
 		// Check if it's the specific "unsupported media" error
 		if errors.Is(err, errUnsupportedMedia) {
 			log.Debug("Skipping unsupported media type", zap.Int("msg_id", msg.ID))
 			return nil // Return nil to indicate it was handled (skipped), not an error
 		}
-		// Log other input location errors as warnings, allows processing to continue
-		log.Warn("Could not get input location", zap.Int("msg_id", msg.ID), zap.Error(err))
-		return err // Return the error to be logged by the caller as a failure
+		return &downloadError{Reason: reasonInvalidMedia, Err: err} // Return the error to be logged by the caller as a failure
 	}
+	if err := target.save(ctx, f, msg, refresh, meta, log); err != nil {
+		savePreviewFallback(ctx, f, msg, target, meta, err, log)
+		return err
+	}
+	return saveAttachment(ctx, f, msg, dest, refresh, meta, log)
+}
 
-	mediaDir := "media_backup"
-	if err := os.MkdirAll(mediaDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create base directory %s: %w", mediaDir, err)
+// saveAttachment downloads the photo or document of a web page preview, game
+// or story next to its rendered artefact, see attachmentOf.
+func saveAttachment(ctx context.Context, f *fetcher, msg *tg.Message, dest mediaDest, refresh refreshFunc, meta *messageMetadata, log *zap.Logger) error {
+	att := attachmentOf(msg)
+	if att == nil {
+		return nil
+	}
+	target, err := newMediaTarget(att, dest, log)
+	if err != nil {
+		return &downloadError{Reason: reasonInvalidMedia, Err: err}
+	}
+	if refresh != nil {
+		msgRefresh := refresh
+		refresh = func(ctx context.Context) (*tg.Message, error) {
+			fresh, err := msgRefresh(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if att := attachmentOf(fresh); att != nil {
+				return att, nil
+			}
+			return nil, errors.New("refreshed message has no attachment")
+		}
 	}
+	if meta != nil {
+		attMeta := *meta // The sidecar describes a different file
+		meta = &attMeta
+	}
+	return target.save(ctx, f, att, refresh, meta, log)
+}
+
+// mediaTarget describes where the media of a message comes from and where it is stored.
+type mediaTarget struct {
+	loc          tg.InputFileLocationClass // nil for rendered artefacts
+	content      []byte                    // Rendered artefact, written instead of downloaded
+	dcID         int                       // Data center the file is stored on
+	fallback     string                    // Kind of preview saved instead of the file, see savePreviewFallback
+	fallbackErr  string                    // Why the file itself couldn't be saved
+	baseFilename string                    // Sanitized file name
+	subDir       string                    // Directory of the file, see pathTemplate
+	destPath     string                    // Final destination path
+	outputDir    string                    // Output directory, holds the content store
+	album        bool                      // Album item in a folder of its own album, sharing album.json
+	sha256       string                    // Content hash, set by the content store
+}
+
+// newMediaTarget resolves the download location of msg and its destination,
+// laid out by the path template of dest.
+// Media without a file of its own is rendered, see mediaArtefact.
+// It returns errUnsupportedMedia for empty and unsupported media.
+func newMediaTarget(msg *tg.Message, dest mediaDest, log *zap.Logger) (*mediaTarget, error) {
+	filename, content, rendered, err := mediaArtefact(msg)
+	if err != nil {
+		if !errors.Is(err, errUnsupportedMedia) {
+			log.Warn("Could not render media", zap.Int("msg_id", msg.ID), zap.Error(err))
+		}
+		return nil, err
+	}
+	var loc tg.InputFileLocationClass
+	if !rendered {
+		loc, filename, err = inputLocation(msg, log) // Pass logger
+		if err != nil {
+			if !errors.Is(err, errUnsupportedMedia) {
+				// Log other input location errors as warnings, allows processing to continue
+				log.Warn("Could not get input location", zap.Int("msg_id", msg.ID), zap.Error(err))
+			}
+			return nil, err
+		}
+	}
+
 	if filename == "" {
 		filename = fmt.Sprintf("%d_%d.dat", msg.ID, time.Now().UnixNano()) // Add timestamp to fallback filename for uniqueness
 		log.Warn("Generated fallback filename", zap.String("filename", filename), zap.Int("msg_id", msg.ID))
 	}
 
 	messageTime := time.Unix(int64(msg.Date), 0)
-	timestamp := messageTime.Format("20060102_150405")        // YYYYMMDD_HHMMSS
-	baseFilename := fmt.Sprintf("%s_%s", timestamp, filename) // Use sanitized filename
-
-	// Determine subdirectory based on FromID (if available)
-	var subDirName string
-	if from, ok := msg.FromID.(*tg.PeerUser); ok {
-		subDirName = strconv.FormatInt(from.UserID, 10)
-	} else if peerUser, ok := msg.PeerID.(*tg.PeerUser); ok { // Fallback to PeerID if FromID is nil (e.g., legacy?)
-		subDirName = strconv.FormatInt(peerUser.UserID, 10)
-	} else if peerChat, ok := msg.PeerID.(*tg.PeerChat); ok {
-		subDirName = fmt.Sprintf("chat_%d", peerChat.ChatID)
-	} else if peerChannel, ok := msg.PeerID.(*tg.PeerChannel); ok {
-		subDirName = fmt.Sprintf("channel_%d", peerChannel.ChannelID)
-	} else {
-		subDirName = "unknown_sender" // Fallback if no ID available
-		log.Warn("Could not determine sender/peer ID for subdirectory", zap.Int("msg_id", msg.ID))
-	}
-	subDir := filepath.Join(mediaDir, subDirName)
+	timestamp := messageTime.Format("20060102_150405") // YYYYMMDD_HHMMSS
+	file := fmt.Sprintf("%s_%s", timestamp, filename)  // Use sanitized filename
+
+	layout := dest.layout.forMessage(msg)
+	destPath := filepath.Join(dest.dir, layout.expand(dest.dir, pathVarsOf(msg, dest, filename, file)))
+	return &mediaTarget{
+		loc:          loc,
+		content:      content,
+		dcID:         mediaDCID(msg.Media),
+		baseFilename: filepath.Base(destPath),
+		subDir:       filepath.Dir(destPath),
+		destPath:     destPath,
+		outputDir:    dest.dir,
+		album:        msg.GroupedID != 0 && layout.inDir("album", "album_id"),
+	}, nil
+}
 
-	// Ensure the subdirectory exists.
-	if err := os.MkdirAll(subDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create subdirectory %s: %w", subDir, err)
+// exists reports whether the destination file is already present.
+func (t *mediaTarget) exists(log *zap.Logger) bool {
+	_, err := os.Stat(t.destPath)
+	if err == nil {
+		return true
+	}
+	if !os.IsNotExist(err) {
+		// Log other stat errors but proceed with download attempt
+		log.Warn("Error checking if file exists", zap.String("path", t.destPath), zap.Error(err))
 	}
+	return false
+}
+
+// maxRefreshes is how often an expired file reference is refreshed per message.
+const maxRefreshes = 2
 
-	// Final destination path inside the subdirectory.
-	destPath := filepath.Join(subDir, baseFilename)
+// save downloads the media to its destination unless it's already there.
+// If the file reference expired and refresh is set, the message is fetched
+// again and the download retried with the new reference. The metadata
+// sidecar is written afterwards if meta is set. The outcome is recorded in
+// the catalogue.
+func (t *mediaTarget) save(ctx context.Context, f *fetcher, msg *tg.Message, refresh refreshFunc, meta *messageMetadata, log *zap.Logger) (err error) {
+	defer func() { t.record(f, msg, meta, err, log) }()
+
+	// Ensure the subdirectory exists.
+	if err := os.MkdirAll(t.subDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create subdirectory %s: %w", t.subDir, err)
+	}
 
 	// Check if file already exists to avoid redownloading (optional but good)
-	if _, err := os.Stat(destPath); err == nil {
-		log.Info("File already exists, skipping download.", zap.String("path", destPath), zap.Int("msg_id", msg.ID))
+	if t.exists(log) {
+		log.Info("File already exists, skipping download.", zap.String("path", t.destPath), zap.Int("msg_id", msg.ID))
+		if meta != nil && !t.hasMetadata(msg) {
+			// Saved by a version without sidecars, or the sidecar write failed.
+			return t.writeMetadata(msg, meta, log)
+		}
 		return nil // Not an error, just skip
-	} else if !os.IsNotExist(err) {
-		// Log other stat errors but proceed with download attempt
-		log.Warn("Error checking if file exists", zap.String("path", destPath), zap.Error(err))
 	}
 
-	// Temporary path *could* be used, but downloading directly might be simpler if rename isn't needed often.
-	// Let's download directly to destPath for simplicity now. Add temp path later if needed.
-	log.Info("Attempting to download media", zap.String("filename", baseFilename), zap.Int("msg_id", msg.ID), zap.String("destination", destPath))
+	if t.loc == nil {
+		if err := writeFileAtomic(t.destPath, t.content); err != nil {
+			return fmt.Errorf("failed to write %s (msg %d): %w", t.baseFilename, msg.ID, err)
+		}
+		log.Info("Saved rendered media", zap.String("path", t.destPath))
+		if meta != nil {
+			return t.writeMetadata(msg, meta, log)
+		}
+		return nil
+	}
 
-	// Download directly to the final destination.
-	_, err = dl.Download(client.API(), loc).ToPath(ctx, destPath)
-	if err != nil {
-		// Attempt to remove partially downloaded file on error
-		_ = os.Remove(destPath)
+	// A file saved before, e.g. when it was posted and deleted again, is
+	// linked from the content store instead of being downloaded again.
+	if store := f.contentStoreFor(t.outputDir); store != nil {
+		hash, ok, err := store.reuse(fileKey(t.loc), t.destPath)
+		if err != nil {
+			log.Warn("Failed to link stored copy, downloading again", zap.String("path", t.destPath), zap.Error(err))
+		}
+		if ok {
+			t.sha256 = hash
+			log.Info("Linked already stored file", zap.String("path", t.destPath), zap.Int("msg_id", msg.ID))
+			if meta != nil {
+				return t.writeMetadata(msg, meta, log)
+			}
+			return nil
+		}
+	}
+
+	// The catalogue knows copies saved for other messages, e.g. in another
+	// album; copying one is faster than downloading the file again.
+	if src := f.catalogFor(t.outputDir).savedCopy(fileKey(t.loc), t.destPath); src != "" {
+		if err := f.copySaved(src, t.destPath); err != nil {
+			log.Warn("Failed to copy saved file, downloading again", zap.String("source", src), zap.Error(err))
+		} else {
+			log.Info("Copied already saved file", zap.String("source", src), zap.String("path", t.destPath), zap.Int("msg_id", msg.ID))
+			t.addToStore(f, log)
+			if meta != nil {
+				return t.writeMetadata(msg, meta, log)
+			}
+			return nil
+		}
+	}
+
+	// The download goes to a .part file first, see fetcher.download.
+	log.Info("Attempting to download media", zap.String("filename", t.baseFilename), zap.Int("msg_id", msg.ID), zap.String("destination", t.destPath))
 
-		// Generic download error
-		return fmt.Errorf("download failed for %s (msg %d): %w", baseFilename, msg.ID, err)
+	for refreshes := 0; ; refreshes++ {
+		err := f.download(ctx, t.loc, t.dcID, t.destPath)
+		if err == nil {
+			break
+		}
+		if failureReasonOf(err) != reasonFileReference || refresh == nil || refreshes >= maxRefreshes {
+			return fmt.Errorf("download failed for %s (msg %d): %w", t.baseFilename, msg.ID, err)
+		}
+
+		log.Info("File reference expired, fetching the message again", zap.Int("msg_id", msg.ID))
+		fresh, refreshErr := refresh(ctx)
+		if refreshErr != nil {
+			return fmt.Errorf("download failed for %s (msg %d): %w (refreshing the file reference failed: %v)", t.baseFilename, msg.ID, err, refreshErr)
+		}
+		loc, _, locErr := inputLocation(fresh, log)
+		if locErr != nil {
+			return fmt.Errorf("download failed for %s (msg %d): %w (refreshed message has no media: %v)", t.baseFilename, msg.ID, err, locErr)
+		}
+		t.loc = loc
+		t.dcID = mediaDCID(fresh.Media)
 	}
 
-	log.Info("Download successful", zap.String("path", destPath))
+	log.Info("Download successful", zap.String("path", t.destPath))
+	t.addToStore(f, log)
+	if meta != nil {
+		return t.writeMetadata(msg, meta, log)
+	}
 	return nil // Explicitly return nil on success
 }
 
+// record records the outcome of saving the file in the catalogue, see
+// catalog.recordFile. The file is saved either way, so failures are only
+// logged.
+func (t *mediaTarget) record(f *fetcher, msg *tg.Message, meta *messageMetadata, saveErr error, log *zap.Logger) {
+	if err := f.catalogFor(t.outputDir).recordFile(t, msg, meta, saveErr); err != nil {
+		log.Warn("Failed to record file in the catalogue", zap.String("path", t.destPath), zap.Error(err))
+	}
+}
+
+// addToStore moves a freshly saved file into the content store. The file is
+// saved either way, so failures are only logged.
+func (t *mediaTarget) addToStore(f *fetcher, log *zap.Logger) {
+	store := f.contentStoreFor(t.outputDir)
+	if store == nil {
+		return
+	}
+	hash, err := store.add(fileKey(t.loc), t.destPath)
+	if err != nil {
+		log.Warn("Failed to deduplicate file", zap.String("path", t.destPath), zap.Error(err))
+		return
+	}
+	t.sha256 = hash
+}
+
+// writeMetadata writes the sidecar of the saved file. Items of an album
+// folder are described together in the album's shared metadata file instead.
+func (t *mediaTarget) writeMetadata(msg *tg.Message, meta *messageMetadata, log *zap.Logger) error {
+	file := mediaFileMeta(msg, t.destPath)
+	file.SHA256 = t.sha256
+	if t.fallback != "" {
+		file.Degraded, file.Fallback, file.Error = true, t.fallback, t.fallbackErr
+		file.MimeType = "image/jpeg"
+	}
+	meta.File = &file
+	if t.album {
+		if err := addToAlbum(t.subDir, meta); err != nil {
+			return fmt.Errorf("failed to write album metadata for msg %d: %w", msg.ID, err)
+		}
+		log.Debug("Updated album metadata", zap.String("path", filepath.Join(t.subDir, albumMetadataName)))
+		return nil
+	}
+	if err := writeMetadata(t.destPath, meta); err != nil {
+		return fmt.Errorf("failed to write metadata for msg %d: %w", msg.ID, err)
+	}
+	log.Debug("Wrote metadata sidecar", zap.String("path", t.destPath+metadataSuffix))
+	return nil
+}
+
+// hasMetadata reports whether the metadata of the saved file was written.
+func (t *mediaTarget) hasMetadata(msg *tg.Message) bool {
+	if t.album {
+		return albumHasItem(t.subDir, msg.ID)
+	}
+	return fileExists(t.destPath + metadataSuffix)
+}
+
 // Define a specific error for unsupported media types
 var errUnsupportedMedia = errors.New("unsupported media type")
 
@@ -394,7 +687,11 @@ func filenameFromDocument(doc *tg.Document, log *zap.Logger) string {
 	for _, a := range doc.Attributes {
 		if attr, ok := a.(*tg.DocumentAttributeFilename); ok && attr.FileName != "" {
 			log.Debug("Found filename attribute", zap.Int64("doc_id", doc.ID), zap.String("filename", attr.FileName))
-			return sanitize(attr.FileName) // Sanitize before returning
+			// A name like "..." sanitizes to nothing, the generated name
+			// below is stable across runs.
+			if name := sanitizeName(attr.FileName); name != "" {
+				return name
+			}
 		}
 	}
 
@@ -423,6 +720,16 @@ func sanitize(s string) string {
 	if s == "" {
 		return "empty_filename"
 	}
+	if sanitized := sanitizeName(s); sanitized != "" {
+		return sanitized
+	}
+	// Nothing was left, e.g. of a name made only of dots.
+	return fmt.Sprintf("sanitized_file_%d", time.Now().UnixNano())
+}
+
+// sanitizeName is sanitize without a fallback: it returns "" if nothing of s
+// is left, so callers can choose a stable name instead.
+func sanitizeName(s string) string {
 	// Replace common path separators first
 	s = strings.ReplaceAll(s, "/", "_")
 	s = strings.ReplaceAll(s, "\\", "_")
@@ -462,8 +769,7 @@ func sanitize(s string) string {
 
 	// Ensure filename is not empty after sanitization
 	if sanitized == "" || sanitized == "." || sanitized == ".." {
-		// If sanitization resulted in empty or invalid name, provide a default
-		return fmt.Sprintf("sanitized_file_%d", time.Now().UnixNano())
+		return ""
 	}
 
 	// Windows reserved names check (case-insensitive)
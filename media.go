@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gotd/td/tg"
+)
+
+// mediaArtefact renders media without a file of its own into a file:
+// locations and venues as GeoJSON, contacts as vCard, and polls, web pages,
+// dice, games, invoices, stories and anything newer as JSON.
+// ok is false for photos and documents, which are downloaded instead.
+func mediaArtefact(msg *tg.Message) (filename string, content []byte, ok bool, err error) {
+	prefix := fmt.Sprintf("msg%d_", msg.ID) // Several artefacts may share a timestamp
+
+	var doc any
+	switch m := msg.Media.(type) {
+	case *tg.MessageMediaPhoto, *tg.MessageMediaDocument:
+		return "", nil, false, nil
+	case *tg.MessageMediaEmpty, *tg.MessageMediaUnsupported, nil:
+		return "", nil, false, errUnsupportedMedia
+
+	case *tg.MessageMediaGeo:
+		content, err = geoJSON(m.Geo, map[string]any{})
+		return prefix + "location.geojson", content, true, err
+	case *tg.MessageMediaGeoLive:
+		content, err = geoJSON(m.Geo, map[string]any{
+			"live":                          true,
+			"heading":                       m.Heading,
+			"period":                        m.Period,
+			"proximity_notification_radius": m.ProximityNotificationRadius,
+		})
+		return prefix + "live_location.geojson", content, true, err
+	case *tg.MessageMediaVenue:
+		content, err = geoJSON(m.Geo, map[string]any{
+			"title":      m.Title,
+			"address":    m.Address,
+			"provider":   m.Provider,
+			"venue_id":   m.VenueID,
+			"venue_type": m.VenueType,
+		})
+		return prefix + "venue_" + sanitize(m.Title) + ".geojson", content, true, err
+
+	case *tg.MessageMediaContact:
+		name := strings.TrimSpace(m.FirstName + " " + m.LastName)
+		return prefix + "contact_" + sanitize(name) + ".vcf", []byte(vCard(m)), true, nil
+
+	case *tg.MessageMediaPoll:
+		filename, doc = prefix+"poll.json", pollArtefact(m)
+	case *tg.MessageMediaWebPage:
+		filename, doc = prefix+"webpage.json", webPageArtefact(m.Webpage)
+	case *tg.MessageMediaDice:
+		filename, doc = prefix+"dice.json", map[string]any{"emoticon": m.Emoticon, "value": m.Value}
+	case *tg.MessageMediaGame:
+		filename, doc = prefix+"game_"+sanitize(m.Game.ShortName)+".json", map[string]any{
+			"short_name":  m.Game.ShortName,
+			"title":       m.Game.Title,
+			"description": m.Game.Description,
+		}
+	case *tg.MessageMediaInvoice:
+		invoice := map[string]any{
+			"title":        m.Title,
+			"description":  m.Description,
+			"currency":     m.Currency,
+			"total_amount": m.TotalAmount, // In the smallest units of the currency
+			"start_param":  m.StartParam,
+			"test":         m.Test,
+		}
+		if photo, ok := m.Photo.(*tg.WebDocument); ok {
+			invoice["photo_url"] = photo.URL
+		}
+		if m.ReceiptMsgID != 0 {
+			invoice["receipt_msg_id"] = m.ReceiptMsgID
+		}
+		filename, doc = prefix+"invoice.json", invoice
+	case *tg.MessageMediaStory:
+		story := map[string]any{
+			"peer":        peerMetaOf(m.Peer),
+			"story_id":    m.ID,
+			"via_mention": m.ViaMention,
+		}
+		if item, ok := m.Story.(*tg.StoryItem); ok {
+			story["date"] = unixTime(item.Date)
+			story["expire_date"] = unixTime(item.ExpireDate)
+			story["caption"] = item.Caption
+			story["markdown"] = renderMarkdown(item.Caption, item.Entities)
+		}
+		filename, doc = prefix+"story.json", story
+	default:
+		// Giveaways, paid media and types added later: keep the raw media.
+		filename, doc = prefix+snakeCase(strings.TrimPrefix(m.TypeName(), "messageMedia"))+".json", m
+	}
+
+	content, err = json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to encode %s: %w", filename, err)
+	}
+	return filename, content, true, nil
+}
+
+// geoJSON returns a GeoJSON feature of the point with the given properties.
+func geoJSON(geo tg.GeoPointClass, props map[string]any) ([]byte, error) {
+	point, ok := geo.(*tg.GeoPoint)
+	if !ok {
+		return nil, fmt.Errorf("location is empty")
+	}
+	if point.AccuracyRadius != 0 {
+		props["accuracy_radius"] = point.AccuracyRadius // Meters
+	}
+	return json.MarshalIndent(map[string]any{
+		"type": "Feature",
+		"geometry": map[string]any{
+			"type":        "Point",
+			"coordinates": []float64{point.Long, point.Lat},
+		},
+		"properties": props,
+	}, "", "  ")
+}
+
+// vCard returns the contact's vCard, building one if Telegram didn't send it.
+func vCard(m *tg.MessageMediaContact) string {
+	if m.Vcard != "" {
+		return m.Vcard
+	}
+	esc := strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteString("BEGIN:VCARD\r\nVERSION:3.0\r\n")
+	fmt.Fprintf(&b, "N:%s;%s;;;\r\n", esc.Replace(m.LastName), esc.Replace(m.FirstName))
+	fmt.Fprintf(&b, "FN:%s\r\n", esc.Replace(strings.TrimSpace(m.FirstName+" "+m.LastName)))
+	if m.PhoneNumber != "" {
+		fmt.Fprintf(&b, "TEL;TYPE=CELL:+%s\r\n", strings.TrimPrefix(m.PhoneNumber, "+"))
+	}
+	if m.UserID != 0 {
+		fmt.Fprintf(&b, "X-TELEGRAM-ID:%d\r\n", m.UserID)
+	}
+	b.WriteString("END:VCARD\r\n")
+	return b.String()
+}
+
+// pollAnswer is an option of a poll together with its results.
+type pollAnswer struct {
+	Text    string `json:"text"`
+	Voters  int    `json:"voters"`
+	Chosen  bool   `json:"chosen,omitempty"`  // Voted for by us
+	Correct bool   `json:"correct,omitempty"` // Quiz answer
+}
+
+func pollArtefact(m *tg.MessageMediaPoll) map[string]any {
+	answers := make([]pollAnswer, 0, len(m.Poll.Answers))
+	for _, a := range m.Poll.Answers {
+		answer := pollAnswer{Text: a.Text.Text}
+		for _, r := range m.Results.Results {
+			if bytes.Equal(r.Option, a.Option) {
+				answer.Voters, answer.Chosen, answer.Correct = r.Voters, r.Chosen, r.Correct
+			}
+		}
+		answers = append(answers, answer)
+	}
+	poll := map[string]any{
+		"question":        m.Poll.Question.Text,
+		"answers":         answers,
+		"total_voters":    m.Results.TotalVoters,
+		"closed":          m.Poll.Closed,
+		"quiz":            m.Poll.Quiz,
+		"multiple_choice": m.Poll.MultipleChoice,
+		"public_voters":   m.Poll.PublicVoters,
+	}
+	if m.Poll.CloseDate != 0 {
+		poll["close_date"] = unixTime(m.Poll.CloseDate)
+	}
+	if m.Results.Solution != "" {
+		poll["solution"] = m.Results.Solution
+	}
+	return poll
+}
+
+func webPageArtefact(page tg.WebPageClass) map[string]any {
+	switch p := page.(type) {
+	case *tg.WebPage:
+		return map[string]any{
+			"url":         p.URL,
+			"display_url": p.DisplayURL,
+			"type":        p.Type,
+			"site_name":   p.SiteName,
+			"title":       p.Title,
+			"description": p.Description,
+			"author":      p.Author,
+			"embed_url":   p.EmbedURL,
+		}
+	case *tg.WebPagePending:
+		return map[string]any{"url": p.URL}
+	case *tg.WebPageEmpty:
+		return map[string]any{"url": p.URL}
+	default:
+		return map[string]any{}
+	}
+}
+
+// attachmentOf returns a message carrying the photo or document that comes
+// with a web page preview, game or story, so it can be downloaded like the
+// media of a regular message. It returns nil if there is none.
+func attachmentOf(msg *tg.Message) *tg.Message {
+	var media tg.MessageMediaClass
+	switch m := msg.Media.(type) {
+	case *tg.MessageMediaWebPage:
+		if page, ok := m.Webpage.(*tg.WebPage); ok {
+			media = fileMedia(page.Photo, page.Document)
+		}
+	case *tg.MessageMediaGame:
+		media = fileMedia(m.Game.Photo, m.Game.Document)
+	case *tg.MessageMediaStory:
+		if item, ok := m.Story.(*tg.StoryItem); ok {
+			switch item.Media.(type) {
+			case *tg.MessageMediaPhoto, *tg.MessageMediaDocument:
+				media = item.Media
+			}
+		}
+	}
+	if media == nil {
+		return nil
+	}
+	att := *msg
+	att.Media = media
+	return &att
+}
+
+// fileMedia prefers the document (e.g. a video) over the photo.
+func fileMedia(photo tg.PhotoClass, doc tg.DocumentClass) tg.MessageMediaClass {
+	if d, ok := doc.(*tg.Document); ok {
+		return &tg.MessageMediaDocument{Document: d}
+	}
+	if p, ok := photo.(*tg.Photo); ok {
+		return &tg.MessageMediaPhoto{Photo: p}
+	}
+	return nil
+}
+
+// artefactMimeType returns the MIME type of a rendered artefact.
+func artefactMimeType(path string) string {
+	switch filepath.Ext(path) {
+	case ".geojson":
+		return "application/geo+json"
+	case ".vcf":
+		return "text/vcard"
+	case ".json":
+		return "application/json"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+)
+
+// metadataSuffix is appended to a recovered file's name to get its sidecar.
+const metadataSuffix = ".json"
+
+// metadataVersion is bumped when the sidecar layout changes incompatibly.
+const metadataVersion = 1
+
+// Sources of recovered messages.
+const (
+	sourceAdminLog = "admin_log"
+	sourceRealtime = "realtime"
+)
+
+// messageMetadata is the JSON sidecar written next to every recovered file.
+// It keeps everything needed to prove what was posted, by whom and who
+// deleted it, including the complete original message.
+type messageMetadata struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"` // admin_log or realtime
+
+	Chat      chatMeta     `json:"chat"`
+	MsgID     int          `json:"msg_id"`
+	Date      time.Time    `json:"date"`
+	EditDate  *time.Time   `json:"edit_date,omitempty"`
+	Sender    *peerMeta    `json:"sender,omitempty"`
+	Text      string       `json:"text,omitempty"` // Text or media caption
+	Markdown  string       `json:"markdown,omitempty"`
+	Entities  []entityMeta `json:"entities,omitempty"`
+	ReplyTo   *replyMeta   `json:"reply_to,omitempty"`
+	Forward   *forwardMeta `json:"forward,omitempty"`
+	GroupedID int64        `json:"grouped_id,omitempty"`
+	Author    string       `json:"post_author,omitempty"`
+	ViaBotID  int64        `json:"via_bot_id,omitempty"`
+
+	Deletion deletionMeta `json:"deletion"`
+	File     *fileMeta    `json:"file,omitempty"` // Not set for text-only messages
+
+	// Complete message: as JSON for reading, as base64 TL for exact decoding.
+	Message   json.RawMessage `json:"message"`
+	MessageTL string          `json:"message_tl"`
+	Event     json.RawMessage `json:"admin_log_event,omitempty"` // Complete delete event, admin log only
+}
+
+// chatMeta describes the chat a message was posted in.
+type chatMeta struct {
+	Kind  string `json:"kind"` // channel, chat or user
+	ID    int64  `json:"id"`
+	Title string `json:"title,omitempty"`
+	Ref   string `json:"ref,omitempty"` // Reference from the config
+}
+
+// peerMeta is a user, chat or channel. The names are set if known, see
+// entityCache.
+type peerMeta struct {
+	Kind     string `json:"kind"`
+	ID       int64  `json:"id"`
+	Username string `json:"username,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// label returns the readable form of the peer, see entityInfo.label.
+func (p *peerMeta) label() string {
+	if p.Username == "" && p.Name == "" {
+		return fmt.Sprintf("%s %d", p.Kind, p.ID)
+	}
+	return entityInfo{Kind: p.Kind, ID: p.ID, Username: p.Username, Name: p.Name}.label()
+}
+
+// entityMeta is a formatting entity of the text.
+type entityMeta struct {
+	Type     string `json:"type"` // bold, italic, text_url, …
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	UserID   int64  `json:"user_id,omitempty"`
+	Language string `json:"language,omitempty"`
+	EmojiID  int64  `json:"custom_emoji_id,omitempty"`
+}
+
+type replyMeta struct {
+	MsgID int       `json:"msg_id,omitempty"`
+	TopID int       `json:"top_id,omitempty"`
+	Peer  *peerMeta `json:"peer,omitempty"`
+	Quote string    `json:"quote,omitempty"`
+}
+
+type forwardMeta struct {
+	From        *peerMeta `json:"from,omitempty"`
+	FromName    string    `json:"from_name,omitempty"`
+	Date        time.Time `json:"date"`
+	ChannelPost int       `json:"channel_post,omitempty"`
+	PostAuthor  string    `json:"post_author,omitempty"`
+}
+
+// deletionMeta describes when and by whom a message was deleted.
+type deletionMeta struct {
+	EventID   int64     `json:"event_id,omitempty"`   // Admin log event
+	DeletedBy int64     `json:"deleted_by,omitempty"` // User ID, unknown for real-time capture
+	Deleter   *peerMeta `json:"deleter,omitempty"`    // Name of DeletedBy, if known
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// fileMeta describes the recovered file.
+type fileMeta struct {
+	Name     string `json:"name"` // Relative to the sidecar
+	Size     int64  `json:"size"`
+	Media    string `json:"media"` // photo, document, …
+	MimeType string `json:"mime_type,omitempty"`
+	SHA256   string `json:"sha256,omitempty"` // Set with -dedup
+
+	// Set when only a low-resolution preview could be recovered.
+	Degraded bool   `json:"degraded,omitempty"`
+	Fallback string `json:"fallback,omitempty"`       // stripped_preview or cached_preview
+	Error    string `json:"download_error,omitempty"` // Why the full file is missing
+}
+
+func peerMetaOf(p tg.PeerClass) *peerMeta {
+	key, ok := peerKeyOf(p)
+	if !ok {
+		return nil
+	}
+	return &peerMeta{Kind: key.Kind.String(), ID: key.ID}
+}
+
+func unixTime(t int) time.Time {
+	return time.Unix(int64(t), 0).UTC()
+}
+
+// entitiesMeta converts message entities, dropping the "messageEntity" prefix
+// of the type names and converting them to snake case.
+func entitiesMeta(entities []tg.MessageEntityClass) []entityMeta {
+	out := make([]entityMeta, 0, len(entities))
+	for _, e := range entities {
+		m := entityMeta{
+			Type:   entityType(e),
+			Offset: e.GetOffset(),
+			Length: e.GetLength(),
+		}
+		switch e := e.(type) {
+		case *tg.MessageEntityTextURL:
+			m.URL = e.URL
+		case *tg.MessageEntityMentionName:
+			m.UserID = e.UserID
+		case *tg.MessageEntityPre:
+			m.Language = e.Language
+		case *tg.MessageEntityCustomEmoji:
+			m.EmojiID = e.DocumentID
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func entityType(e tg.MessageEntityClass) string {
+	return snakeCase(strings.TrimPrefix(e.TypeName(), "messageEntity"))
+}
+
+// snakeCase converts a TL type name like "TextUrl" to "text_url".
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// newMessageMetadata collects the metadata of msg. The file section is filled by the caller.
+func newMessageMetadata(msg *tg.Message, chat chatMeta, source string, deletion deletionMeta) (*messageMetadata, error) {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message as JSON: %w", err)
+	}
+	var b bin.Buffer
+	if err := msg.Encode(&b); err != nil {
+		return nil, fmt.Errorf("failed to encode message as TL: %w", err)
+	}
+
+	meta := &messageMetadata{
+		Version:   metadataVersion,
+		Source:    source,
+		Chat:      chat,
+		MsgID:     msg.ID,
+		Date:      unixTime(msg.Date),
+		Sender:    peerMetaOf(msg.FromID),
+		Text:      msg.Message,
+		Markdown:  renderMarkdown(msg.Message, msg.Entities),
+		Entities:  entitiesMeta(msg.Entities),
+		GroupedID: msg.GroupedID,
+		Author:    msg.PostAuthor,
+		ViaBotID:  msg.ViaBotID,
+		Deletion:  deletion,
+		Message:   raw,
+		MessageTL: base64.StdEncoding.EncodeToString(b.Buf),
+	}
+	if msg.EditDate != 0 {
+		t := unixTime(msg.EditDate)
+		meta.EditDate = &t
+	}
+	if meta.Sender == nil && chat.Kind == kindUser.String() {
+		// Private chats may omit from_id for messages of the other side.
+		meta.Sender = &peerMeta{Kind: chat.Kind, ID: chat.ID}
+	}
+	if reply, ok := msg.ReplyTo.(*tg.MessageReplyHeader); ok {
+		meta.ReplyTo = &replyMeta{
+			MsgID: reply.ReplyToMsgID,
+			TopID: reply.ReplyToTopID,
+			Peer:  peerMetaOf(reply.ReplyToPeerID),
+			Quote: reply.QuoteText,
+		}
+	}
+	if fwd, ok := msg.GetFwdFrom(); ok {
+		meta.Forward = &forwardMeta{
+			From:        peerMetaOf(fwd.FromID),
+			FromName:    fwd.FromName,
+			Date:        unixTime(fwd.Date),
+			ChannelPost: fwd.ChannelPost,
+			PostAuthor:  fwd.PostAuthor,
+		}
+	}
+	return meta, nil
+}
+
+// adminLogDeletion describes the deletion recorded by an admin log event.
+func adminLogDeletion(ev tg.ChannelAdminLogEvent) deletionMeta {
+	return deletionMeta{
+		EventID:   ev.ID,
+		DeletedBy: ev.UserID,
+		DeletedAt: unixTime(ev.Date),
+	}
+}
+
+// adminLogMetadata collects the metadata of a message deleted in ev.
+func adminLogMetadata(msg *tg.Message, chat chatMeta, ev tg.ChannelAdminLogEvent) (*messageMetadata, error) {
+	meta, err := newMessageMetadata(msg, chat, sourceAdminLog, adminLogDeletion(ev))
+	if err != nil {
+		return nil, err
+	}
+	if meta.Event, err = json.Marshal(ev); err != nil {
+		return nil, fmt.Errorf("failed to encode admin log event: %w", err)
+	}
+	return meta, nil
+}
+
+// mediaFileMeta describes the media of msg saved at path.
+func mediaFileMeta(msg *tg.Message, path string) fileMeta {
+	fm := fileMeta{Name: filepath.Base(path)}
+	if info, err := os.Stat(path); err == nil {
+		fm.Size = info.Size()
+	}
+	switch m := msg.Media.(type) {
+	case *tg.MessageMediaPhoto:
+		fm.Media = "photo"
+		fm.MimeType = "image/jpeg"
+	case *tg.MessageMediaDocument:
+		fm.Media = "document"
+		if doc, ok := m.Document.AsNotEmpty(); ok {
+			fm.MimeType = doc.MimeType
+		}
+	default:
+		fm.Media = snakeCase(strings.TrimPrefix(msg.Media.TypeName(), "messageMedia"))
+		fm.MimeType = artefactMimeType(path)
+	}
+	return fm
+}
+
+// message decodes the original message from its TL encoding.
+func (m *messageMetadata) message() (*tg.Message, error) {
+	data, err := base64.StdEncoding.DecodeString(m.MessageTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message %d: %w", m.MsgID, err)
+	}
+	var msg tg.Message
+	if err := msg.Decode(&bin.Buffer{Buf: data}); err != nil {
+		return nil, fmt.Errorf("failed to decode message %d: %w", m.MsgID, err)
+	}
+	return &msg, nil
+}
+
+// writeMetadata stores meta as the sidecar of the media file at path.
+func writeMetadata(path string, meta *messageMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return writeFileAtomic(path+metadataSuffix, data)
+}
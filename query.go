@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// queryCommands read what earlier runs recovered. They don't log in to
+// Telegram.
+var queryCommands = []string{"list", "show", "search", "stats"}
+
+// statsGroups are the accepted values of stats -by.
+var statsGroups = []string{"sender", "deleter", "type", "day"}
+
+// archiveFilter selects entries of the archive for the query commands.
+type archiveFilter struct {
+	channel      string
+	sender       string // User ID, @username or part of the name
+	deleter      string
+	kinds        []string
+	since, until time.Time // Of the deletion
+	text         string    // Part of the text, file name or sender
+}
+
+func (q archiveFilter) match(e archiveEntry) bool {
+	if q.channel != "" && !matchChat(e.Meta.Chat, q.channel) {
+		return false
+	}
+	if q.sender != "" && !matchPeer(e.Meta.Sender, q.sender) && !strings.EqualFold(e.Meta.Author, q.sender) {
+		return false
+	}
+	if q.deleter != "" && !matchPeer(e.deleter(), q.deleter) {
+		return false
+	}
+	if len(q.kinds) > 0 && !slices.Contains(q.kinds, e.Kind) {
+		return false
+	}
+	if deleted := e.deletedAt(); (!q.since.IsZero() && deleted.Before(q.since)) || (!q.until.IsZero() && deleted.After(q.until)) {
+		return false
+	}
+	if q.text != "" {
+		text := strings.ToLower(q.text)
+		if !strings.Contains(strings.ToLower(e.Meta.Text), text) &&
+			!strings.Contains(strings.ToLower(filepath.Base(e.Path)), text) &&
+			!strings.Contains(strings.ToLower(e.sender()), text) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse sets the deletion time bounds from dates or durations, see
+// parseDate, and checks the kinds.
+func (q *archiveFilter) parse(since, until string) error {
+	for _, bound := range []struct {
+		flag, value string
+		t           *time.Time
+		end         bool
+	}{{"since", since, &q.since, false}, {"until", until, &q.until, true}} {
+		t, d, err := parseDate(bound.value, bound.end)
+		if err != nil {
+			return fmt.Errorf("-%s: %w", bound.flag, err)
+		}
+		if d > 0 {
+			t = time.Now().Add(-d)
+		}
+		*bound.t = t
+	}
+	if _, err := kindSet(q.kinds); err != nil {
+		return fmt.Errorf("-type: %w", err)
+	}
+	return nil
+}
+
+// matchChat matches a chat by its reference from the config, ID or title.
+func matchChat(chat chatMeta, q string) bool {
+	if id, err := strconv.ParseInt(q, 10, 64); err == nil {
+		return chat.ID == id
+	}
+	return strings.EqualFold(chat.Ref, q) || strings.Contains(strings.ToLower(chat.Title), strings.ToLower(q))
+}
+
+// matchPeer matches a peer by ID, @username or part of the name.
+func matchPeer(p *peerMeta, q string) bool {
+	if p == nil {
+		return false
+	}
+	if id, err := strconv.ParseInt(q, 10, 64); err == nil {
+		return p.ID == id
+	}
+	if username, ok := strings.CutPrefix(q, "@"); ok {
+		return strings.EqualFold(p.Username, username)
+	}
+	return p.Name != "" && strings.Contains(strings.ToLower(p.Name), strings.ToLower(q))
+}
+
+// archiveItem is an entry as printed by list and search.
+type archiveItem struct {
+	Channel   string    `json:"channel"`
+	MsgID     int       `json:"msg_id"`
+	Date      time.Time `json:"date"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Type      string    `json:"type"`
+	Sender    string    `json:"sender,omitempty"`
+	Deleter   string    `json:"deleter,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`   // With -dedup or -catalog
+	Degraded  bool      `json:"degraded,omitempty"` // Only a preview was recovered
+}
+
+func (e archiveEntry) item() archiveItem {
+	item := archiveItem{
+		Channel:   e.channel(),
+		MsgID:     e.Meta.MsgID,
+		Date:      e.Meta.Date,
+		DeletedAt: e.Meta.Deletion.DeletedAt,
+		Type:      e.Kind,
+		Sender:    e.sender(),
+		Text:      e.Meta.Text,
+		Size:      e.size(),
+		Path:      e.Path,
+	}
+	if d := e.deleter(); d != nil {
+		item.Deleter = d.label()
+	}
+	if e.Meta.File != nil {
+		item.SHA256, item.Degraded = e.Meta.File.SHA256, e.Meta.File.Degraded
+	}
+	return item
+}
+
+// statsRow is one group of stats.
+type statsRow struct {
+	Key      string `json:"key"`
+	Messages int    `json:"messages"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// runQuery runs one of queryCommands and returns the exit code.
+func runQuery(command string, args []string, out io.Writer) int {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	var (
+		dirs   []string
+		filter archiveFilter
+		since  string
+		until  string
+	)
+	fs.Func("dir", "output directory to read, with its catalog.db if there is one; may be repeated (default: the output directories of the config)", listFlag(&dirs))
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.StringVar(&filter.channel, "channel", "", "only messages of this chat: its reference from the config, ID or part of the title")
+	if command != "show" {
+		fs.StringVar(&filter.sender, "sender", "", "only messages sent by this user: ID, @username or part of the name")
+		fs.StringVar(&filter.deleter, "deleter", "", "only messages deleted by this user: ID, @username or part of the name")
+		fs.Func("type", "only these comma-separated kinds: "+strings.Join(messageKinds, ", "), listFlag(&filter.kinds))
+		fs.StringVar(&since, "since", "", "only messages deleted after this date (2024-01-31, RFC 3339) or within this duration (168h)")
+		fs.StringVar(&until, "until", "", "only messages deleted before this date or duration")
+	}
+	limit := 0
+	if command == "list" || command == "search" {
+		fs.IntVar(&limit, "limit", 0, "only print the most recently deleted messages, 0 prints all")
+	}
+	by := "sender"
+	if command == "stats" {
+		fs.StringVar(&by, "by", "sender", "group by "+strings.Join(statsGroups, ", "))
+	}
+
+	// Flags may follow the arguments, e.g. "show 4211 -json".
+	var positional []string
+	for {
+		_ = fs.Parse(args) // ExitOnError handles failures
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	usage := func(format string, a ...any) int {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+		return 2
+	}
+	if err := filter.parse(since, until); err != nil {
+		return usage("Invalid %v", err)
+	}
+	var msgID int
+	switch command {
+	case "show":
+		if len(positional) != 1 {
+			return usage("Usage: show [-channel chat] [-json] <msg_id>")
+		}
+		id, err := strconv.Atoi(positional[0])
+		if err != nil || id <= 0 {
+			return usage("Invalid message ID %q", positional[0])
+		}
+		msgID = id
+	case "search":
+		if len(positional) == 0 {
+			return usage("Usage: search [flags] <text>")
+		}
+		filter.text = strings.Join(positional, " ")
+	default:
+		if len(positional) > 0 {
+			return usage("%s takes no arguments, got %q", command, strings.Join(positional, " "))
+		}
+	}
+	if command == "stats" && !slices.Contains(statsGroups, by) {
+		return usage("Invalid -by %q, use one of %s", by, strings.Join(statsGroups, ", "))
+	}
+
+	entries, err := loadArchive(archiveDirs(dirs))
+	if err != nil {
+		// Report unreadable files, but show what could be read.
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	var matched []archiveEntry
+	for _, e := range entries {
+		if filter.match(e) && (msgID == 0 || e.Meta.MsgID == msgID) {
+			matched = append(matched, e)
+		}
+	}
+
+	switch command {
+	case "show":
+		if len(matched) == 0 {
+			fmt.Fprintf(os.Stderr, "Message %d not found\n", msgID)
+			return 1
+		}
+		err = printShow(out, matched, *asJSON)
+	case "stats":
+		err = printStats(out, archiveStats(matched, by), by, *asJSON)
+	default:
+		if limit > 0 && len(matched) > limit {
+			matched = matched[len(matched)-limit:]
+		}
+		err = printList(out, matched, *asJSON)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// archiveDirs returns the output directories to read: the given ones, or
+// those of the config, or the default.
+func archiveDirs(dirs []string) []string {
+	if len(dirs) > 0 {
+		return dirs
+	}
+	_ = godotenv.Load() // The config may be set there, see main
+	cfg, err := loadConfig()
+	if err != nil {
+		return []string{defaultMediaDir}
+	}
+	for _, ch := range cfg.Channels {
+		if !slices.Contains(dirs, ch.OutputDir) {
+			dirs = append(dirs, ch.OutputDir)
+		}
+	}
+	return dirs
+}
+
+func writeJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printList writes entries as a table, one row per saved file or text message.
+func printList(out io.Writer, entries []archiveEntry, asJSON bool) error {
+	items := make([]archiveItem, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, e.item())
+	}
+	if asJSON {
+		return writeJSON(out, items)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DELETED\tCHANNEL\tMSG ID\tTYPE\tSENDER\tDELETED BY\tSIZE\tFILE OR TEXT")
+	for _, item := range items {
+		content := item.Path
+		if content == "" {
+			content = summary(item.Text, 60)
+		}
+		size := "-"
+		if item.Size > 0 {
+			size = formatSize(item.Size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			formatLocal(item.DeletedAt), item.Channel, item.MsgID, item.Type, orDash(item.Sender), orDash(item.Deleter), size, content)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%d messages\n", countMessages(entries))
+	return err
+}
+
+// printShow writes everything known about one message. Several chats may
+// have a message with the same ID, each is printed.
+func printShow(out io.Writer, entries []archiveEntry, asJSON bool) error {
+	if asJSON {
+		metas := make([]*messageMetadata, 0, len(entries))
+		for _, e := range entries {
+			metas = append(metas, e.Meta)
+		}
+		return writeJSON(out, metas)
+	}
+	var b strings.Builder
+	file := func(e archiveEntry) {
+		fmt.Fprintf(&b, "File:       %s\n", fileLine(e))
+		if e.Meta.File != nil && e.Meta.File.SHA256 != "" {
+			fmt.Fprintf(&b, "SHA-256:    %s\n", e.Meta.File.SHA256)
+		}
+	}
+	for i, e := range entries {
+		if i > 0 && e.messageID() == entries[i-1].messageID() {
+			file(e)
+			continue
+		}
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		meta := e.Meta
+		fmt.Fprintf(&b, "Message %d in %s (%s %d)\n", meta.MsgID, e.channel(), meta.Chat.Kind, meta.Chat.ID)
+		fmt.Fprintf(&b, "Posted:     %s\n", formatLocal(meta.Date))
+		fmt.Fprintf(&b, "From:       %s\n", orDash(e.sender()))
+		deleted := formatLocal(meta.Deletion.DeletedAt)
+		if d := e.deleter(); d != nil {
+			deleted += " by " + d.label()
+		}
+		fmt.Fprintf(&b, "Deleted:    %s\n", deleted)
+		fmt.Fprintf(&b, "Type:       %s\n", e.Kind)
+		if meta.ReplyTo != nil && meta.ReplyTo.MsgID != 0 {
+			fmt.Fprintf(&b, "Reply to:   message %d\n", meta.ReplyTo.MsgID)
+		}
+		if fwd := meta.Forward; fwd != nil {
+			switch {
+			case fwd.From != nil:
+				fmt.Fprintf(&b, "Forwarded:  from %s\n", fwd.From.label())
+			case fwd.FromName != "":
+				fmt.Fprintf(&b, "Forwarded:  from %s\n", fwd.FromName)
+			}
+		}
+		if e.Path != "" {
+			file(e)
+		}
+		if meta.Text != "" {
+			fmt.Fprintf(&b, "\n%s\n", meta.Text)
+		}
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// fileLine describes the saved file of an entry.
+func fileLine(e archiveEntry) string {
+	line := e.Path
+	if size := e.size(); size > 0 {
+		line += " (" + formatSize(size) + ")"
+	}
+	if e.Meta.File != nil && e.Meta.File.Degraded {
+		line += " [preview only]"
+	}
+	return line
+}
+
+// archiveStats counts messages, files and bytes per group.
+func archiveStats(entries []archiveEntry, by string) []statsRow {
+	groups := make(map[string]*statsRow)
+	counted := make(map[string]bool) // Messages already counted
+	for _, e := range entries {
+		var key string
+		switch by {
+		case "sender":
+			key = e.sender()
+		case "deleter":
+			if d := e.deleter(); d != nil {
+				key = d.label()
+			}
+		case "type":
+			key = e.Kind
+		case "day":
+			key = e.deletedAt().Local().Format(time.DateOnly)
+		}
+		if key == "" {
+			key = "unknown"
+		}
+		row, ok := groups[key]
+		if !ok {
+			row = &statsRow{Key: key}
+			groups[key] = row
+		}
+		if id := e.messageID(); !counted[id] {
+			counted[id] = true
+			row.Messages++
+		}
+		if e.Path != "" {
+			row.Files++
+			row.Bytes += e.size()
+		}
+	}
+
+	rows := make([]statsRow, 0, len(groups))
+	for _, row := range groups {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if by != "day" && rows[i].Messages != rows[j].Messages {
+			return rows[i].Messages > rows[j].Messages
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	return rows
+}
+
+// printStats writes the stats as a table with a total.
+func printStats(out io.Writer, rows []statsRow, by string, asJSON bool) error {
+	if asJSON {
+		return writeJSON(out, rows)
+	}
+	var total statsRow
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "%s\tMESSAGES\tFILES\tSIZE\t\n", strings.ToUpper(by))
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n", row.Key, row.Messages, row.Files, formatSize(row.Bytes))
+		total.Messages += row.Messages
+		total.Files += row.Files
+		total.Bytes += row.Bytes
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t%s\t\n", total.Messages, total.Files, formatSize(total.Bytes))
+	return w.Flush()
+}
+
+// countMessages returns the number of different messages of entries.
+func countMessages(entries []archiveEntry) int {
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.messageID()] = true
+	}
+	return len(seen)
+}
+
+// summary returns the first line of text, shortened to n runes.
+func summary(text string, n int) string {
+	text, _, _ = strings.Cut(text, "\n")
+	if r := []rune(text); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return text
+}
+
+func formatLocal(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// cacheDirName is the directory inside an output directory holding media
+// downloaded ahead of a possible deletion.
+const cacheDirName = ".cache"
+
+// messageKey identifies a message. Channel message IDs are per channel, while
+// private chats and basic groups share one ID sequence, so ChannelID is 0 for them.
+type messageKey struct {
+	ChannelID int64
+	MsgID     int
+}
+
+// cachedMessage is a recently seen message. It is also persisted in the cache
+// directory, so a restart doesn't forget messages that may still be deleted.
+type cachedMessage struct {
+	msg       *tg.Message
+	ch        ChannelConfig
+	seen      time.Time
+	target    *mediaTarget // nil for text-only messages
+	cachePath string       // Set once the media was downloaded ahead of time
+}
+
+// realtimeCapture follows new-message updates of watched chats and saves the
+// media or text of messages that get deleted while they are still in the cache.
+type realtimeCapture struct {
+	client *telegram.Client
+	f      *fetcher
+	log    *zap.Logger
+
+	ttl     time.Duration // How long a message stays cached
+	maxSize int           // Maximum number of cached messages
+	eager   bool          // Download media on arrival instead of on deletion
+	thumbs  bool          // Also save thumbnails and previews
+	filter  *messageFilter
+	layout  *pathTemplate // From -path-template, channels may have their own
+	history int           // Recent messages fetched when a chat is first watched
+
+	mux      sync.Mutex
+	watched  map[peerKey]ChannelConfig
+	chats    map[peerKey]chatMeta // Metadata of watched chats, for sidecars
+	messages map[messageKey]*cachedMessage
+
+	downloads sync.WaitGroup
+	sem       chan struct{} // Limits concurrent eager downloads
+}
+
+func newRealtimeCapture(client *telegram.Client, f *fetcher, opts runOptions, log *zap.Logger) *realtimeCapture {
+	return &realtimeCapture{
+		client:   client,
+		f:        f,
+		log:      log,
+		ttl:      opts.CacheTTL,
+		maxSize:  opts.CacheSize,
+		eager:    opts.Eager,
+		thumbs:   opts.Thumbnails,
+		filter:   opts.Filter,
+		layout:   opts.Layout,
+		history:  opts.History,
+		watched:  make(map[peerKey]ChannelConfig),
+		chats:    make(map[peerKey]chatMeta),
+		messages: make(map[messageKey]*cachedMessage),
+		sem:      make(chan struct{}, opts.Concurrency),
+	}
+}
+
+// register installs the update handlers on the dispatcher.
+func (r *realtimeCapture) register(d tg.UpdateDispatcher) {
+	d.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewChannelMessage) error {
+		r.onMessage(ctx, e, u.Message)
+		return nil
+	})
+	d.OnEditChannelMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateEditChannelMessage) error {
+		r.onMessage(ctx, e, u.Message)
+		return nil
+	})
+	d.OnNewMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateNewMessage) error {
+		r.onMessage(ctx, e, u.Message)
+		return nil
+	})
+	d.OnEditMessage(func(ctx context.Context, e tg.Entities, u *tg.UpdateEditMessage) error {
+		r.onMessage(ctx, e, u.Message)
+		return nil
+	})
+	d.OnDeleteChannelMessages(func(ctx context.Context, e tg.Entities, u *tg.UpdateDeleteChannelMessages) error {
+		r.onDelete(ctx, u.ChannelID, u.Messages)
+		return nil
+	})
+	d.OnDeleteMessages(func(ctx context.Context, e tg.Entities, u *tg.UpdateDeleteMessages) error {
+		r.onDelete(ctx, 0, u.Messages)
+		return nil
+	})
+}
+
+// watch starts caching messages of the chat. Messages persisted by a previous
+// run are restored and the most recent history is fetched, so media posted
+// before the tool started can still be saved if it's deleted now.
+func (r *realtimeCapture) watch(ctx context.Context, peer *resolvedPeer, ch ChannelConfig) {
+	key := peer.peerKey()
+	r.mux.Lock()
+	_, known := r.watched[key]
+	r.watched[key] = ch
+	r.chats[key] = chatMeta{Kind: peer.Kind.String(), ID: peer.ID, Title: peer.Title, Ref: ch.ref.String()}
+	r.mux.Unlock()
+	if known {
+		return
+	}
+
+	log := r.log.With(zap.Stringer("channel", ch.ref))
+	log.Info("Capturing new messages in real time", zap.Stringer("kind", peer.Kind), zap.Int64("id", peer.ID), zap.String("title", peer.Title))
+	r.restore(ctx, key, ch, log)
+
+	if r.history <= 0 {
+		return
+	}
+	res, err := r.client.API().MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{Peer: peer.Input, Limit: r.history})
+	if err != nil {
+		log.Warn("Failed to fetch recent history", zap.Error(err))
+		return
+	}
+	modified, ok := res.AsModified()
+	if !ok {
+		return
+	}
+	entitiesFor(ch.OutputDir).addPeers(modified.GetUsers(), modified.GetChats())
+	for _, m := range modified.GetMessages() {
+		r.onMessage(ctx, tg.Entities{}, m)
+	}
+	log.Debug("Cached recent history", zap.Int("messages", len(modified.GetMessages())))
+}
+
+// keyOf returns the cache key of msg and the config of its chat, if it's watched.
+func (r *realtimeCapture) keyOf(msg *tg.Message) (messageKey, ChannelConfig, bool) {
+	peer, ok := peerKeyOf(msg.PeerID)
+	if !ok {
+		return messageKey{}, ChannelConfig{}, false
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ch, ok := r.watched[peer]
+	key := messageKey{MsgID: msg.ID}
+	if peer.Kind == kindChannel {
+		key.ChannelID = peer.ID
+	}
+	return key, ch, ok
+}
+
+// onMessage caches a new or edited message. e are the users and chats of the
+// update, their names are remembered for naming the saved files.
+func (r *realtimeCapture) onMessage(ctx context.Context, e tg.Entities, m tg.MessageClass) {
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return
+	}
+	key, ch, ok := r.keyOf(msg)
+	if !ok {
+		return
+	}
+	entitiesFor(ch.OutputDir).addEntities(e)
+	log := r.log.With(zap.Stringer("channel", ch.ref), zap.Int("msg_id", msg.ID))
+	// The deleting user is never known here, so filtering on arrival is enough.
+	if accepted, why := ch.accepts(r.filter, msg, 0); !accepted {
+		log.Debug("Not caching filtered message", zap.String("reason", why))
+		return
+	}
+
+	target, err := r.cacheTarget(msg, ch, log)
+	if errors.Is(err, errUnsupportedMedia) {
+		return
+	}
+	if err != nil {
+		log.Debug("Not caching message", zap.Error(err))
+		return
+	}
+
+	entry := &cachedMessage{msg: msg, ch: ch, seen: time.Now(), target: target}
+	r.mux.Lock()
+	if old, ok := r.messages[key]; ok {
+		if old.msg.EditDate == msg.EditDate {
+			// Already known, e.g. restored and then seen again in history.
+			r.mux.Unlock()
+			return
+		}
+		if old.cachePath != "" {
+			// Edited media replaces the previously downloaded copy.
+			_ = os.Remove(old.cachePath)
+		}
+	}
+	r.messages[key] = entry
+	r.mux.Unlock()
+	if err := persistMessage(messagePath(ch, key), msg); err != nil {
+		log.Warn("Failed to persist cached message", zap.Error(err))
+	}
+	if target == nil {
+		log.Debug("Cached text message")
+		return
+	}
+	log.Debug("Cached message with media", zap.String("filename", target.baseFilename))
+
+	if r.eager && target.loc != nil {
+		r.prefetch(ctx, key, entry, log)
+	}
+}
+
+// cacheTarget returns the media target of msg, or nil for text-only messages.
+// The destination is resolved again once the message is deleted.
+func (r *realtimeCapture) cacheTarget(msg *tg.Message, ch ChannelConfig, log *zap.Logger) (*mediaTarget, error) {
+	if msg.Media == nil {
+		return nil, nil
+	}
+	return newMediaTarget(msg, r.destOf(msg, ch, deletionMeta{}), log)
+}
+
+// destOf returns where the media of msg is saved. deletion is zero while
+// the message isn't deleted.
+func (r *realtimeCapture) destOf(msg *tg.Message, ch ChannelConfig, deletion deletionMeta) mediaDest {
+	var chat chatMeta
+	if peer, ok := peerKeyOf(msg.PeerID); ok {
+		r.mux.Lock()
+		chat = r.chats[peer]
+		r.mux.Unlock()
+	}
+	return mediaDest{dir: ch.OutputDir, layout: ch.pathLayout(r.layout), chat: chat, deletion: deletion, names: entitiesFor(ch.OutputDir)}
+}
+
+// restore loads the persisted messages of a chat from its cache directory.
+func (r *realtimeCapture) restore(ctx context.Context, peer peerKey, ch ChannelConfig, log *zap.Logger) {
+	paths, err := filepath.Glob(filepath.Join(ch.OutputDir, cacheDirName, "*"+cachedMessageExt))
+	if err != nil || len(paths) == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-r.ttl)
+	restored := 0
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		msg, err := loadMessage(path)
+		if err != nil {
+			log.Warn("Dropping unreadable cached message", zap.String("path", path), zap.Error(err))
+			_ = os.Remove(path)
+			continue
+		}
+		if key, ok := peerKeyOf(msg.PeerID); !ok || key != peer {
+			continue // Another chat sharing the output directory
+		}
+		key, _, _ := r.keyOf(msg)
+		target, err := r.cacheTarget(msg, ch, log)
+		if err != nil {
+			_ = os.Remove(path)
+			continue
+		}
+		entry := &cachedMessage{msg: msg, ch: ch, seen: info.ModTime(), target: target}
+		if target != nil {
+			if mediaPath := prefetchPath(ch, key, target); fileExists(mediaPath) {
+				entry.cachePath = mediaPath
+			}
+		}
+		r.mux.Lock()
+		if entry.seen.Before(deadline) {
+			r.drop(key, entry)
+		} else if _, ok := r.messages[key]; !ok {
+			r.messages[key] = entry
+			restored++
+		}
+		r.mux.Unlock()
+	}
+	if restored > 0 {
+		log.Info("Restored cached messages from previous run", zap.Int("messages", restored))
+	}
+}
+
+// prefetch downloads the media of a cached message in the background, so it
+// survives even if the file becomes unavailable after deletion.
+func (r *realtimeCapture) prefetch(ctx context.Context, key messageKey, entry *cachedMessage, log *zap.Logger) {
+	path := prefetchPath(entry.ch, key, entry.target)
+	r.downloads.Add(1)
+	go func() {
+		defer r.downloads.Done()
+		select {
+		case r.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-r.sem }()
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Warn("Failed to create cache directory", zap.Error(err))
+			return
+		}
+		if err := r.f.download(ctx, entry.target.loc, entry.target.dcID, path); err != nil {
+			log.Warn("Failed to prefetch media", zap.Error(err))
+			return
+		}
+
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		if r.messages[key] != entry {
+			// Evicted, edited or already handled while downloading.
+			_ = os.Remove(path)
+			return
+		}
+		entry.cachePath = path
+		log.Debug("Prefetched media", zap.String("path", path))
+	}()
+}
+
+func (r *realtimeCapture) onDelete(ctx context.Context, channelID int64, ids []int) {
+	for _, id := range ids {
+		key := messageKey{ChannelID: channelID, MsgID: id}
+		r.mux.Lock()
+		entry, ok := r.messages[key]
+		var (
+			cachePath string
+			chat      chatMeta
+		)
+		if ok {
+			cachePath = entry.cachePath
+			if peer, known := peerKeyOf(entry.msg.PeerID); known {
+				chat = r.chats[peer]
+			}
+			delete(r.messages, key)
+		}
+		r.mux.Unlock()
+		if !ok {
+			continue
+		}
+		_ = os.Remove(messagePath(entry.ch, key))
+
+		log := r.log.With(zap.Stringer("channel", entry.ch.ref), zap.Int("msg_id", id))
+		// Updates don't say who deleted a message, only when it happened.
+		deletion := deletionMeta{DeletedAt: time.Now().UTC()}
+		meta, err := newMessageMetadata(entry.msg, chat, sourceRealtime, deletion)
+		names := entitiesFor(entry.ch.OutputDir)
+		names.describe(meta)
+		if err := names.save(); err != nil {
+			log.Warn("Failed to save the names of users and chats", zap.Error(err))
+		}
+		if entry.target == nil {
+			if err == nil {
+				err = saveDeletedText(entry.ch.OutputDir, meta, log)
+			}
+			if err == nil {
+				err = r.f.catalogFor(entry.ch.OutputDir).recordMessage(entry.msg, meta)
+			}
+			if err != nil {
+				log.Warn("Failed to save deleted text message", zap.Error(err))
+			}
+			continue
+		}
+		if err != nil {
+			log.Warn("Failed to collect message metadata, saving media without it", zap.Error(err))
+		}
+		// The path template may use the deletion.
+		dest := r.destOf(entry.msg, entry.ch, deletion)
+		target := entry.target
+		if t, err := newMediaTarget(entry.msg, dest, log); err == nil {
+			target = t
+		}
+		log.Info("Cached message was deleted, saving media", zap.Time("date", time.Unix(int64(entry.msg.Date), 0)))
+		// Don't block the update handler with the download.
+		r.downloads.Add(1)
+		go func() {
+			defer r.downloads.Done()
+			if r.thumbs {
+				defer saveThumbnails(ctx, r.f, entry.msg, dest, log)
+			}
+			err := r.saveDeleted(ctx, entry.msg, target, dest, cachePath, meta, log)
+			if err == nil {
+				return
+			}
+			reason := failureReasonOf(err)
+			log.Warn("Failed to save media of deleted message", zap.String("reason", string(reason)), zap.Error(err))
+			if reason == reasonCanceled {
+				return
+			}
+			if err := recordFailure(entry.ch.OutputDir, failureRecord{
+				Time:     time.Now(),
+				Channel:  entry.ch.ref.String(),
+				MsgID:    id,
+				Reason:   reason,
+				Error:    err.Error(),
+				Attempts: attemptsOf(err),
+			}); err != nil {
+				log.Warn("Failed to record failure", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// saveDeleted moves the prefetched copy into place, or downloads the media now.
+// meta is written as the sidecar of the saved file if set.
+func (r *realtimeCapture) saveDeleted(ctx context.Context, msg *tg.Message, target *mediaTarget, dest mediaDest, cachePath string, meta *messageMetadata, log *zap.Logger) error {
+	if cachePath != "" {
+		err := r.savePrefetched(msg, target, cachePath, meta, log)
+		target.record(r.f, msg, meta, err, log)
+		return err
+	}
+	if err := target.save(ctx, r.f, msg, nil, meta, log); err != nil {
+		savePreviewFallback(ctx, r.f, msg, target, meta, err, log)
+		return err
+	}
+	return saveAttachment(ctx, r.f, msg, dest, nil, meta, log)
+}
+
+// savePrefetched moves the copy downloaded by prefetch into place.
+func (r *realtimeCapture) savePrefetched(msg *tg.Message, target *mediaTarget, cachePath string, meta *messageMetadata, log *zap.Logger) error {
+	if err := os.MkdirAll(target.subDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create subdirectory %s: %w", target.subDir, err)
+	}
+	if target.exists(log) {
+		_ = os.Remove(cachePath)
+		log.Info("File already exists, skipping.", zap.String("path", target.destPath))
+		if meta != nil && !target.hasMetadata(msg) {
+			return target.writeMetadata(msg, meta, log)
+		}
+		return nil
+	}
+	if err := os.Rename(cachePath, target.destPath); err != nil {
+		return fmt.Errorf("failed to move prefetched file: %w", err)
+	}
+	log.Info("Saved prefetched media", zap.String("path", target.destPath))
+	target.addToStore(r.f, log)
+	if meta != nil {
+		return target.writeMetadata(msg, meta, log)
+	}
+	return nil
+}
+
+// evict drops messages older than the TTL and the oldest ones above maxSize.
+func (r *realtimeCapture) evict() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	deadline := time.Now().Add(-r.ttl)
+	for key, entry := range r.messages {
+		if entry.seen.Before(deadline) {
+			r.drop(key, entry)
+		}
+	}
+
+	if over := len(r.messages) - r.maxSize; over > 0 {
+		keys := make([]messageKey, 0, len(r.messages))
+		for key := range r.messages {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return r.messages[keys[i]].seen.Before(r.messages[keys[j]].seen)
+		})
+		for _, key := range keys[:over] {
+			r.drop(key, r.messages[key])
+		}
+	}
+}
+
+func (r *realtimeCapture) drop(key messageKey, entry *cachedMessage) {
+	if entry.cachePath != "" {
+		_ = os.Remove(entry.cachePath)
+	}
+	_ = os.Remove(messagePath(entry.ch, key))
+	delete(r.messages, key)
+}
+
+// run evicts stale cache entries until ctx is cancelled, then waits for
+// running prefetches to finish.
+func (r *realtimeCapture) run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.downloads.Wait()
+			return nil
+		case <-ticker.C:
+			r.evict()
+		}
+	}
+}
+
+// cachedMessageExt is the extension of persisted messages in the cache directory.
+const cachedMessageExt = ".msg"
+
+// messagePath returns where a cached message is persisted.
+func messagePath(ch ChannelConfig, key messageKey) string {
+	return filepath.Join(ch.OutputDir, cacheDirName, fmt.Sprintf("%d_%d%s", key.ChannelID, key.MsgID, cachedMessageExt))
+}
+
+// prefetchPath returns where the media of a cached message is downloaded to
+// in eager mode. It doesn't depend on the path template, whose values may
+// change until the message is deleted.
+func prefetchPath(ch ChannelConfig, key messageKey, target *mediaTarget) string {
+	return filepath.Join(ch.OutputDir, cacheDirName, fmt.Sprintf("%d_%d_media%s", key.ChannelID, key.MsgID, filepath.Ext(target.destPath)))
+}
+
+// persistMessage stores msg in its TL encoding, which keeps the file reference intact.
+func persistMessage(path string, msg *tg.Message) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	var b bin.Buffer
+	if err := msg.Encode(&b); err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	return os.WriteFile(path, b.Buf, 0o644)
+}
+
+// loadMessage reads a message written by persistMessage.
+func loadMessage(path string) (*tg.Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := tg.DecodeMessage(&bin.Buffer{Buf: data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", m)
+	}
+	return msg, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
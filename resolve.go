@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gotd/td/telegram/query/dialogs"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// botAPIChannelOffset is subtracted from channel IDs in the Bot API form:
+// channel 1234567890 is -1001234567890. Basic groups are just negated.
+const botAPIChannelOffset = 1_000_000_000_000
+
+// userRefPrefix marks a numeric user ID (user:123456789), since bare IDs mean channels.
+const userRefPrefix = "user:"
+
+// peerKind is the type of chat a reference points to.
+type peerKind int
+
+const (
+	kindUnknown peerKind = iota // Public username, known after resolving
+	kindChannel                 // Channel or supergroup
+	kindChat                    // Basic group
+	kindUser                    // Private chat with a user
+)
+
+func (k peerKind) String() string {
+	switch k {
+	case kindChannel:
+		return "channel"
+	case kindChat:
+		return "chat"
+	case kindUser:
+		return "user"
+	default:
+		return "unknown"
+	}
+}
+
+// peerRef is a parsed chat reference: either a numeric ID of a known kind or a public username.
+type peerRef struct {
+	Kind     peerKind
+	ID       int64
+	Username string
+}
+
+func (r peerRef) String() string {
+	switch {
+	case r.Username != "":
+		return "@" + r.Username
+	case r.Kind == kindChat:
+		return "-" + strconv.FormatInt(r.ID, 10)
+	case r.Kind == kindUser:
+		return userRefPrefix + strconv.FormatInt(r.ID, 10)
+	default:
+		return strconv.FormatInt(r.ID, 10)
+	}
+}
+
+// parsePeerRef normalises the accepted chat notations:
+//
+//	1234567890                    bare channel ID
+//	-1001234567890                Bot API channel form
+//	-123456789                    Bot API basic group form
+//	user:123456789                private chat with a user
+//	@name, name                   public username (channel or user)
+//	https://t.me/name             public link (also t.me/s/name, telegram.me/name)
+//	https://t.me/c/1234567890/42  private message link
+func parsePeerRef(s string) (peerRef, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return peerRef{}, errors.New("empty chat reference")
+	}
+
+	if rest, ok := strings.CutPrefix(s, userRefPrefix); ok {
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || id <= 0 {
+			return peerRef{}, fmt.Errorf("invalid user ID %q", s)
+		}
+		return peerRef{Kind: kindUser, ID: id}, nil
+	}
+
+	// Numeric forms.
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if id < 0 {
+			// Decided by value, not by a "-100" prefix: basic group 1001234 is -1001234.
+			if id > -botAPIChannelOffset {
+				return peerRef{Kind: kindChat, ID: -id}, nil
+			}
+			id = -id - botAPIChannelOffset
+			if id <= 0 {
+				return peerRef{}, fmt.Errorf("invalid Bot API channel ID %q", s)
+			}
+		}
+		if id == 0 {
+			return peerRef{}, errors.New("channel ID must not be zero")
+		}
+		return peerRef{Kind: kindChannel, ID: id}, nil
+	}
+
+	// Links.
+	link := strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	link = strings.TrimPrefix(link, "www.")
+	for _, host := range []string{"t.me/", "telegram.me/", "telegram.dog/"} {
+		if !strings.HasPrefix(link, host) {
+			continue
+		}
+		path := strings.TrimPrefix(link, host)
+		if i := strings.IndexAny(path, "?#"); i != -1 {
+			path = path[:i]
+		}
+		parts := strings.Split(strings.Trim(path, "/"), "/")
+		switch {
+		case len(parts) >= 2 && parts[0] == "c":
+			id, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || id <= 0 {
+				return peerRef{}, fmt.Errorf("invalid private channel link %q", s)
+			}
+			return peerRef{Kind: kindChannel, ID: id}, nil
+		case len(parts) >= 2 && parts[0] == "s":
+			return usernameRef(parts[1], s)
+		case len(parts) >= 1 && parts[0] != "" && !strings.HasPrefix(parts[0], "+") && parts[0] != "joinchat":
+			return usernameRef(parts[0], s)
+		default:
+			return peerRef{}, fmt.Errorf("unsupported link %q (invite links cannot be resolved, join the chat and use its ID)", s)
+		}
+	}
+
+	return usernameRef(strings.TrimPrefix(s, "@"), s)
+}
+
+// usernameRef validates a public username. Telegram usernames are 4-32
+// characters of a-z, 0-9 and underscores.
+func usernameRef(name, orig string) (peerRef, error) {
+	if len(name) < 4 || len(name) > 32 {
+		return peerRef{}, fmt.Errorf("invalid chat reference %q", orig)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return peerRef{}, fmt.Errorf("invalid chat reference %q", orig)
+		}
+	}
+	return peerRef{Username: name}, nil
+}
+
+// resolvedPeer is a chat reference resolved against Telegram.
+type resolvedPeer struct {
+	Kind    peerKind
+	ID      int64
+	Title   string
+	Input   tg.InputPeerClass
+	Channel *tg.Channel // Set for channels, needed for the admin log
+}
+
+// peerKey returns the key identifying the chat in updates.
+func (p *resolvedPeer) peerKey() peerKey {
+	return peerKey{Kind: p.Kind, ID: p.ID}
+}
+
+// peerKey identifies a chat across updates and configs.
+type peerKey struct {
+	Kind peerKind
+	ID   int64
+}
+
+// peerKeyOf returns the key of a message's chat.
+func peerKeyOf(p tg.PeerClass) (peerKey, bool) {
+	switch p := p.(type) {
+	case *tg.PeerChannel:
+		return peerKey{Kind: kindChannel, ID: p.ChannelID}, true
+	case *tg.PeerChat:
+		return peerKey{Kind: kindChat, ID: p.ChatID}, true
+	case *tg.PeerUser:
+		return peerKey{Kind: kindUser, ID: p.UserID}, true
+	default:
+		return peerKey{}, false
+	}
+}
+
+// resolvePeer resolves a chat reference of any kind. Channels go through
+// resolveInputChannel and resolveChannel, so the usual checks apply.
+func resolvePeer(ctx context.Context, api *tg.Client, ref peerRef, log *zap.Logger) (*resolvedPeer, error) {
+	if ref.Username != "" {
+		res, err := api.ContactsResolveUsername(ctx, &tg.ContactsResolveUsernameRequest{Username: ref.Username})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve username %s: %w", ref, err)
+		}
+		switch peer := res.Peer.(type) {
+		case *tg.PeerChannel:
+			for _, chat := range res.Chats {
+				if channel, ok := chat.(*tg.Channel); ok && channel.ID == peer.ChannelID {
+					log.Debug("Resolved channel username", zap.String("username", ref.Username), zap.Int64("id", channel.ID))
+					return channelPeer(ctx, api, channel.AsInput())
+				}
+			}
+			return nil, fmt.Errorf("username %s resolved to channel %d, but it was not included in the response", ref, peer.ChannelID)
+		case *tg.PeerUser:
+			for _, u := range res.Users {
+				if user, ok := u.(*tg.User); ok && user.ID == peer.UserID {
+					log.Debug("Resolved user username", zap.String("username", ref.Username), zap.Int64("id", user.ID))
+					return userPeer(user), nil
+				}
+			}
+			return nil, fmt.Errorf("username %s resolved to user %d, but it was not included in the response", ref, peer.UserID)
+		default:
+			return nil, fmt.Errorf("username %s resolved to unsupported peer %T", ref, res.Peer)
+		}
+	}
+
+	switch ref.Kind {
+	case kindChannel:
+		input, err := resolveInputChannel(ctx, api, ref, log)
+		if err != nil {
+			return nil, err
+		}
+		return channelPeer(ctx, api, input)
+	case kindChat:
+		res, err := api.MessagesGetChats(ctx, []int64{ref.ID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get basic group %d: %w", ref.ID, err)
+		}
+		for _, c := range res.GetChats() {
+			switch chat := c.(type) {
+			case *tg.Chat:
+				return &resolvedPeer{Kind: kindChat, ID: chat.ID, Title: chat.Title, Input: &tg.InputPeerChat{ChatID: chat.ID}}, nil
+			case *tg.ChatForbidden:
+				return nil, fmt.Errorf("access to basic group %d (%s) is forbidden", chat.ID, chat.Title)
+			}
+		}
+		return nil, fmt.Errorf("no basic group found for ID %d. Ensure your account is a member", ref.ID)
+	case kindUser:
+		log.Debug("Looking up user in dialogs", zap.Int64("id", ref.ID))
+		var found *tg.User
+		err := forEachDialog(ctx, api, func(elem dialogs.Elem) bool {
+			found = elem.Entities.Users()[ref.ID]
+			return found != nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, fmt.Errorf("user %d not found in your dialogs. Open a chat with them first", ref.ID)
+		}
+		return userPeer(found), nil
+	default:
+		return nil, fmt.Errorf("cannot resolve %s", ref)
+	}
+}
+
+func channelPeer(ctx context.Context, api *tg.Client, input *tg.InputChannel) (*resolvedPeer, error) {
+	channel, err := resolveChannel(ctx, api, input)
+	if err != nil {
+		return nil, err
+	}
+	return &resolvedPeer{
+		Kind:    kindChannel,
+		ID:      channel.ID,
+		Title:   channel.Title,
+		Input:   &tg.InputPeerChannel{ChannelID: channel.ID, AccessHash: channel.AccessHash},
+		Channel: channel,
+	}, nil
+}
+
+func userPeer(user *tg.User) *resolvedPeer {
+	title := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if title == "" {
+		title = user.Username
+	}
+	return &resolvedPeer{
+		Kind:  kindUser,
+		ID:    user.ID,
+		Title: title,
+		Input: &tg.InputPeerUser{UserID: user.ID, AccessHash: user.AccessHash},
+	}
+}
+
+// resolveInputChannel turns a channel reference into an InputChannel with a valid access hash.
+// Numeric IDs are looked up in the user's dialogs. If the dialog can't be found,
+// AccessHash 0 is used as before.
+func resolveInputChannel(ctx context.Context, api *tg.Client, ref peerRef, log *zap.Logger) (*tg.InputChannel, error) {
+	log.Debug("Looking up channel in dialogs", zap.Int64("id", ref.ID))
+	var found *tg.InputChannel
+	err := forEachDialog(ctx, api, func(elem dialogs.Elem) bool {
+		if channel, ok := elem.Entities.Channels()[ref.ID]; ok {
+			found = channel.AsInput()
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		log.Warn("Channel not found in dialogs, falling back to zero access hash", zap.Int64("id", ref.ID))
+		return &tg.InputChannel{ChannelID: ref.ID, AccessHash: 0}, nil
+	}
+	return found, nil
+}
+
+// forEachDialog calls fn for the user's dialogs until it returns true.
+func forEachDialog(ctx context.Context, api *tg.Client, fn func(elem dialogs.Elem) bool) error {
+	errFound := errors.New("found")
+	err := dialogs.NewQueryBuilder(api).GetDialogs().BatchSize(100).ForEach(ctx, func(ctx context.Context, elem dialogs.Elem) error {
+		if fn(elem) {
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return fmt.Errorf("failed to iterate dialogs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestParsePeerRef(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    peerRef
+		wantErr bool
+	}{
+		{in: "1234567890", want: peerRef{Kind: kindChannel, ID: 1234567890}},
+		{in: " 1234567890 ", want: peerRef{Kind: kindChannel, ID: 1234567890}},
+		{in: "-1001234567890", want: peerRef{Kind: kindChannel, ID: 1234567890}},
+		{in: "-1000000000001", want: peerRef{Kind: kindChannel, ID: 1}},
+		{in: "-123456789", want: peerRef{Kind: kindChat, ID: 123456789}},
+		{in: "-1001234", want: peerRef{Kind: kindChat, ID: 1001234}},
+		{in: "-999999999999", want: peerRef{Kind: kindChat, ID: 999999999999}},
+		{in: "user:123456789", want: peerRef{Kind: kindUser, ID: 123456789}},
+		{in: "@channelname", want: peerRef{Username: "channelname"}},
+		{in: "channelname", want: peerRef{Username: "channelname"}},
+		{in: "https://t.me/channelname", want: peerRef{Username: "channelname"}},
+		{in: "http://www.t.me/channelname?single", want: peerRef{Username: "channelname"}},
+		{in: "t.me/s/channelname", want: peerRef{Username: "channelname"}},
+		{in: "https://telegram.me/channelname/42", want: peerRef{Username: "channelname"}},
+		{in: "https://telegram.dog/channelname", want: peerRef{Username: "channelname"}},
+		{in: "https://t.me/c/1234567890/42", want: peerRef{Kind: kindChannel, ID: 1234567890}},
+
+		{in: "", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-1000000000000", wantErr: true},
+		{in: "user:abc", wantErr: true},
+		{in: "user:-5", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "@bad-name", wantErr: true},
+		{in: "https://t.me/+AbCdEf123", wantErr: true},
+		{in: "https://t.me/joinchat/AbCdEf123", wantErr: true},
+		{in: "https://t.me/c/abc/42", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePeerRef(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePeerRef(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePeerRef(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePeerRef(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
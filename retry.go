@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+// failureReason is the class of a download error.
+type failureReason string
+
+const (
+	reasonFileReference failureReason = "file_reference_expired" // Needs a fresh file reference
+	reasonFloodWait     failureReason = "flood_wait"             // Telegram asked to slow down
+	reasonNetwork       failureReason = "network"                // Connection problems, timeouts
+	reasonServer        failureReason = "server_error"           // Telegram internal errors
+	reasonRPC           failureReason = "rpc_error"              // Other Telegram errors, retrying won't help
+	reasonFilesystem    failureReason = "filesystem"             // Local disk errors
+	reasonCanceled      failureReason = "canceled"               // Shutdown
+	reasonInvalidMedia  failureReason = "invalid_media"          // No downloadable location
+)
+
+// retryLater reports whether a message that failed for this reason may be
+// saved by a later run, so its admin log event should be processed again.
+// Local disk errors usually need the user to act, they aren't retried.
+func (r failureReason) retryLater() bool {
+	switch r {
+	case reasonFileReference, reasonFloodWait, reasonNetwork, reasonServer, reasonCanceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// classifyError returns the failure reason of err and whether retrying the
+// same request may succeed.
+func classifyError(err error) (failureReason, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return reasonCanceled, false
+	}
+	if _, ok := tgerr.AsFloodWait(err); ok {
+		return reasonFloodWait, true
+	}
+	if rpcErr, ok := tgerr.As(err); ok {
+		switch {
+		case strings.HasPrefix(rpcErr.Type, "FILE_REFERENCE_"):
+			return reasonFileReference, false
+		case rpcErr.Code >= 500 || rpcErr.Code == -503 || rpcErr.Type == "TIMEOUT":
+			return reasonServer, true
+		default:
+			return reasonRPC, false
+		}
+	}
+	var (
+		pathErr *fs.PathError
+		linkErr *os.LinkError
+	)
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return reasonFilesystem, false
+	}
+	// Everything else comes from the connection: resets, EOFs, timeouts.
+	return reasonNetwork, true
+}
+
+// downloadError is a download failure after all retries.
+type downloadError struct {
+	Reason   failureReason
+	Err      error
+	Attempts int
+}
+
+func (e *downloadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *downloadError) Unwrap() error {
+	return e.Err
+}
+
+// failureReasonOf returns the recorded reason of a failed save.
+func failureReasonOf(err error) failureReason {
+	var dlErr *downloadError
+	if errors.As(err, &dlErr) {
+		return dlErr.Reason
+	}
+	reason, _ := classifyError(err)
+	return reason
+}
+
+// backoff returns the delay before retry number attempt (1-based): 1s, 2s, 4s, … capped at a minute.
+func backoff(attempt int) time.Duration {
+	const maxDelay = time.Minute
+	d := time.Second << (attempt - 1)
+	if d <= 0 || d > maxDelay {
+		return maxDelay
+	}
+	return d
+}
+
+// attemptsOf returns the number of download attempts of a failed save, if known.
+func attemptsOf(err error) int {
+	var dlErr *downloadError
+	if errors.As(err, &dlErr) {
+		return dlErr.Attempts
+	}
+	return 0
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// refreshFunc fetches the message again to get a fresh file reference.
+type refreshFunc func(ctx context.Context) (*tg.Message, error)
+
+// failuresFileName is the file inside the state directory listing media that couldn't be saved.
+const failuresFileName = "failures.jsonl"
+
+// failureRecord is one line of the failures file.
+type failureRecord struct {
+	Time     time.Time     `json:"time"`
+	Channel  string        `json:"channel"`
+	MsgID    int           `json:"msg_id"`
+	EventID  int64         `json:"event_id,omitempty"` // Admin log event, 0 for real-time capture
+	Reason   failureReason `json:"reason"`
+	Error    string        `json:"error"`
+	Attempts int           `json:"attempts,omitempty"`
+}
+
+var failuresMux sync.Mutex
+
+// failedRuns counts the failures recorded for each admin log event in the
+// failures file of an output directory before the given time, i.e. by
+// earlier runs. A missing file has none.
+func failedRuns(outputDir string, before time.Time) (map[int64]int, error) {
+	failuresMux.Lock()
+	defer failuresMux.Unlock()
+
+	path := filepath.Join(outputDir, stateDirName, failuresFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[int64]int{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	counts := make(map[int64]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		var rec failureRecord
+		if json.Unmarshal([]byte(line), &rec) != nil || rec.EventID == 0 || !rec.Time.Before(before) {
+			continue
+		}
+		counts[rec.EventID]++
+	}
+	return counts, nil
+}
+
+// recordFailure appends the final failure reason of a message to the failures
+// file of its output directory.
+func recordFailure(outputDir string, rec failureRecord) error {
+	failuresMux.Lock()
+	defer failuresMux.Unlock()
+
+	path := filepath.Join(outputDir, stateDirName, failuresFileName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode failure: %w", err)
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return out.Close()
+}
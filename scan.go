@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// resolveChannel looks up the channel and returns it together with its access hash.
+func resolveChannel(ctx context.Context, api *tg.Client, input *tg.InputChannel) (*tg.Channel, error) {
+	channelID := input.ChannelID
+	list, err := api.ChannelsGetChannels(ctx, []tg.InputChannelClass{input})
+	if err != nil {
+		// Provide more context on potential channel ID issues
+		if strings.Contains(err.Error(), "CHANNEL_INVALID") || strings.Contains(err.Error(), "PEER_ID_INVALID") {
+			return nil, fmt.Errorf("failed to get channel info (ID: %d). Error: %w. Please ensure the Channel ID in your config/environment is correct and the bot/user is a member (or admin) of the channel", channelID, err)
+		}
+		return nil, fmt.Errorf("ChannelsGetChannels request failed (ID: %d): %w", channelID, err)
+	}
+
+	if len(list.GetChats()) == 0 {
+		return nil, fmt.Errorf("no channel found for the provided ID: %d (from config/environment). Ensure the ID is correct and your account is a member", channelID)
+	}
+
+	channelInfo, ok := list.GetChats()[0].(*tg.Channel)
+	if !ok {
+		// Could be a tg.Chat, tg.ChatForbidden etc.
+		chat := list.GetChats()[0]
+		chatType := fmt.Sprintf("%T", chat) // Get the type
+		if forbidden, isForbidden := chat.(*tg.ChannelForbidden); isForbidden {
+			return nil, fmt.Errorf("access to channel %d is forbidden until %s. Reason: %s", forbidden.ID, time.Unix(int64(forbidden.UntilDate), 0).Format(time.RFC3339), forbidden.Title)
+		}
+		return nil, fmt.Errorf("the provided ID %d does not belong to an accessible Channel (supergroup/channel). Found type: %s", channelID, chatType)
+	}
+
+	return channelInfo, nil
+}
+
+// lookupPeer resolves the configured chat reference.
+func lookupPeer(ctx context.Context, api *tg.Client, ch ChannelConfig, log *zap.Logger) (*resolvedPeer, error) {
+	log.Info("Getting chat information...")
+	peer, err := resolvePeer(ctx, api, ch.ref, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if peer.Channel != nil {
+		log.Info("Successfully found channel", zap.String("title", peer.Channel.Title), zap.Int64("id", peer.Channel.ID), zap.Int64("access_hash", peer.Channel.AccessHash))
+	} else {
+		log.Info("Successfully found chat", zap.Stringer("kind", peer.Kind), zap.String("title", peer.Title), zap.Int64("id", peer.ID))
+	}
+	return peer, nil
+}
+
+// scanAll resolves and scans every channel once, one after another.
+// A failing channel doesn't stop the others. Basic groups and private chats
+// have no admin log and are skipped.
+func scanAll(ctx context.Context, client *telegram.Client, f *fetcher, channels []ChannelConfig, opts runOptions, log *zap.Logger) error {
+	var errs []error
+	for _, ch := range channels {
+		chLog := log.With(zap.Stringer("channel", ch.ref))
+		if ch.ref.Kind == kindChat || ch.ref.Kind == kindUser {
+			chLog.Warn("Basic groups and private chats have no admin log, use \"watch -realtime\" for them. Skipping.")
+			continue
+		}
+		peer, err := lookupPeer(ctx, client.API(), ch, chLog)
+		if err == nil && peer.Channel == nil {
+			chLog.Warn("Basic groups and private chats have no admin log, use \"watch -realtime\" for them. Skipping.")
+			continue
+		}
+		if err == nil {
+			var total int
+			total, err = scanChannel(ctx, client, f, ch, peer.Channel, opts, chLog)
+			if err == nil {
+				chLog.Info("Finished processing channel.", zap.Int("total_files_potentially_saved", total))
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		chLog.Error("Failed to process channel", zap.Error(err))
+		errs = append(errs, fmt.Errorf("channel %s: %w", ch.ref, err))
+	}
+	return errors.Join(errs...)
+}
+
+// walkAdminLog pages through the delete events of the channel's admin log,
+// newest first, and calls fn for every event newer than minID.
+func walkAdminLog(ctx context.Context, api *tg.Client, channelInfo *tg.Channel, minID int64, log *zap.Logger, fn func(ev tg.ChannelAdminLogEvent, res *tg.ChannelsAdminLogResults) error) error {
+	// Iterate over log in 100-event pages.
+	var maxID int64 // start from 0 = newest
+	for {
+		req := &tg.ChannelsGetAdminLogRequest{
+			Channel: &tg.InputChannel{
+				ChannelID:  channelInfo.ID,
+				AccessHash: channelInfo.AccessHash,
+			},
+			EventsFilter: tg.ChannelAdminLogEventsFilter{
+				Delete: true,
+			},
+			Limit: 100,
+			MaxID: maxID,
+			MinID: minID,
+		}
+
+		log.Debug("Requesting admin log page", zap.Int64("max_id", maxID), zap.Int64("min_id", minID))
+		res, err := api.ChannelsGetAdminLog(ctx, req)
+		if err != nil {
+			return fmt.Errorf("failed to execute GetAdminLog request: %w", err)
+		}
+
+		log.Debug("Fetched admin log page", zap.Int("event_count", len(res.Events)), zap.Int("user_count", len(res.Users)), zap.Int("chat_count", len(res.Chats)))
+
+		if len(res.Events) == 0 {
+			log.Info("Reached end of admin log for delete events.")
+			return nil // no more pages
+		}
+
+		for _, ev := range res.Events {
+			if ev.ID <= minID {
+				// Already handled by a previous run.
+				log.Info("Reached events processed by a previous run.", zap.Int64("last_event_id", minID))
+				return nil
+			}
+			maxID = ev.ID // Update maxID for the next page request (important to do for every event)
+			if err := fn(ev, res); err != nil {
+				return err
+			}
+		}
+
+		// Optional: Add a small delay to avoid hitting rate limits, although GetAdminLog is usually less sensitive.
+		// log.Debug("Sleeping briefly before next request...")
+		// time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// refetchDeletedMessage requests a single admin log event again. The message
+// in the fresh copy carries a new file reference.
+func refetchDeletedMessage(ctx context.Context, api *tg.Client, channelInfo *tg.Channel, eventID int64) (*tg.Message, error) {
+	res, err := api.ChannelsGetAdminLog(ctx, &tg.ChannelsGetAdminLogRequest{
+		Channel:      channelInfo.AsInput(),
+		EventsFilter: tg.ChannelAdminLogEventsFilter{Delete: true},
+		MinID:        eventID - 1,
+		MaxID:        eventID + 1,
+		Limit:        1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch admin log event %d: %w", eventID, err)
+	}
+	for _, ev := range res.Events {
+		if ev.ID != eventID {
+			continue
+		}
+		if del, ok := ev.Action.(*tg.ChannelAdminLogEventActionDeleteMessage); ok {
+			if msg, ok := del.Message.(*tg.Message); ok {
+				return msg, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("admin log event %d is no longer available", eventID)
+}
+
+// scanChannel walks the admin log of a single channel and saves media and text of deleted messages.
+// Unless opts.Full is set, only events newer than the persisted cursor are processed.
+// Media is downloaded by a worker pool while the log is still being walked.
+// It returns the number of media messages processed.
+func scanChannel(ctx context.Context, client *telegram.Client, f *fetcher, ch ChannelConfig, channelInfo *tg.Channel, opts runOptions, log *zap.Logger) (int, error) {
+	stPath := statePath(ch.OutputDir, channelInfo.ID)
+	cat := f.catalogFor(ch.OutputDir)
+	st, err := loadCursor(stPath, channelInfo.ID, cat, log)
+	if err != nil {
+		return 0, err
+	}
+	minID := st.LastEventID
+	if opts.Full {
+		log.Info("Full scan requested, ignoring saved cursor", zap.Int64("last_event_id", st.LastEventID))
+		minID = 0
+	}
+
+	var (
+		lastEventID int64 // Highest event ID seen in this run, becomes the new cursor
+		pool        = newDownloadPool(ctx, f, opts.Concurrency)
+		chat        = chatMeta{Kind: kindChannel.String(), ID: channelInfo.ID, Title: channelInfo.Title, Ref: ch.ref.String()}
+		albums      = make(map[int64][]downloadJob) // Grouped ID -> items
+		names       = entitiesFor(ch.OutputDir)
+		page        *tg.ChannelsAdminLogResults
+		filtered    int
+	)
+	log.Info("Fetching admin log for deleted messages...", zap.String("output_dir", ch.OutputDir), zap.Int64("min_id", minID))
+	walkErr := walkAdminLog(ctx, client.API(), channelInfo, minID, log, func(ev tg.ChannelAdminLogEvent, res *tg.ChannelsAdminLogResults) error {
+		if ev.ID > lastEventID {
+			lastEventID = ev.ID
+		}
+		if res != page {
+			names.addResults(res)
+			page = res
+		}
+		if err := cat.recordEvent(channelInfo.ID, ev); err != nil {
+			log.Warn("Failed to record event in the catalogue", zap.Error(err))
+		}
+		// We only care about delete-message events.
+		del, ok := ev.Action.(*tg.ChannelAdminLogEventActionDeleteMessage)
+		if !ok {
+			log.Debug("Skipping non-delete admin log event", zap.String("type", fmt.Sprintf("%T", ev.Action)))
+			return nil
+		}
+		if msg, ok := del.Message.(*tg.Message); ok {
+			if accepted, why := ch.accepts(opts.Filter, msg, ev.UserID); !accepted {
+				log.Debug("Skipping filtered message", zap.Int("msg_id", msg.ID), zap.String("reason", why))
+				filtered++
+				return nil
+			}
+		}
+		// del.Message can be *tg.Message, *tg.MessageService…
+		if msg, ok := del.Message.(*tg.Message); ok && msg.Media != nil {
+			log.Info("Found deleted message with media", zap.Int("msg_id", msg.ID), zap.Time("date", time.Unix(int64(msg.Date), 0)))
+			eventID := ev.ID
+			meta, err := adminLogMetadata(msg, chat, ev)
+			if err != nil {
+				log.Warn("Failed to collect message metadata, saving media without it", zap.Int("msg_id", msg.ID), zap.Error(err))
+			}
+			names.describe(meta)
+			job := downloadJob{
+				msg:     msg,
+				dest:    ch.adminLogDest(opts.Layout, chat, ev),
+				channel: ch.ref.String(),
+				eventID: eventID,
+				eventAt: unixTime(ev.Date),
+				refresh: func(ctx context.Context) (*tg.Message, error) {
+					return refetchDeletedMessage(ctx, client.API(), channelInfo, eventID)
+				},
+				meta:   meta,
+				thumbs: opts.Thumbnails,
+				log:    log,
+			}
+			if msg.GroupedID != 0 {
+				// Album items may be spread over several events and pages,
+				// they are saved together once the walk is done.
+				albums[msg.GroupedID] = append(albums[msg.GroupedID], job)
+				return nil
+			}
+			return pool.submit(ctx, job)
+		} else if ok {
+			// Text-only message, goes to the chat's text log.
+			meta, err := adminLogMetadata(msg, chat, ev)
+			if err == nil {
+				names.describe(meta)
+				err = saveDeletedText(ch.OutputDir, meta, log)
+			}
+			if err == nil {
+				err = cat.recordMessage(msg, meta)
+			}
+			if err != nil {
+				log.Warn("Failed to save deleted text message", zap.Int("msg_id", msg.ID), zap.Error(err))
+			}
+		} else if msgService, ok := del.Message.(*tg.MessageService); ok {
+			log.Debug("Found deleted service message", zap.Int("msg_id", msgService.ID))
+		}
+		return nil
+	})
+
+	if err := submitAlbums(ctx, pool, albums, log); err != nil && walkErr == nil {
+		walkErr = err
+	}
+
+	// Wait for all downloads to finish, so the count includes every worker.
+	total, failed := pool.wait()
+	if err := names.save(); err != nil {
+		log.Warn("Failed to save the names of users and chats", zap.Error(err))
+	}
+	if filtered > 0 {
+		log.Info("Skipped messages not matching the filter", zap.Int("filtered", filtered))
+	}
+	if failed > 0 {
+		log.Warn("Some media could not be saved", zap.Int("failed", failed))
+	}
+	if walkErr != nil {
+		return total, walkErr
+	}
+	if ctx.Err() != nil {
+		// Downloads still running were cancelled, their events must be
+		// processed again.
+		return total, ctx.Err()
+	}
+
+	// Only move the cursor forward after the whole log was walked, so an
+	// interrupted run is repeated next time instead of leaving a gap. Media
+	// that failed with a transient error keeps the cursor before its event,
+	// so the next run tries again; media saved meanwhile is skipped then.
+	cursor := lastEventID
+	if retry := pool.oldestRetry(); retry != 0 {
+		cursor = retry - 1
+		log.Info("Keeping the cursor before media that failed to download, it is retried on the next run", zap.Int64("event_id", retry))
+	}
+	if cursor > st.LastEventID {
+		st.ChannelID = channelInfo.ID
+		st.LastEventID = cursor
+		st.UpdatedAt = time.Now()
+		if err := saveState(stPath, st); err != nil {
+			return total, err
+		}
+		if err := cat.saveCursor(channelInfo.ID, cursor); err != nil {
+			log.Warn("Failed to record cursor in the catalogue", zap.Error(err))
+		}
+		log.Debug("Saved admin log cursor", zap.String("path", stPath), zap.Int64("last_event_id", cursor))
+	}
+
+	return total, nil
+}
+
+// submitAlbums queues the items of every collected album in chat order.
+func submitAlbums(ctx context.Context, pool *downloadPool, albums map[int64][]downloadJob, log *zap.Logger) error {
+	for groupedID, jobs := range albums {
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].msg.ID < jobs[j].msg.ID })
+		log.Info("Found deleted album", zap.Int64("grouped_id", groupedID), zap.Int("items", len(jobs)))
+		for _, job := range jobs {
+			if err := pool.submit(ctx, job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// galleryReload is how long the gallery server reuses the archive before
+	// reading the output directories again, so new recoveries show up.
+	galleryReload = 10 * time.Second
+
+	// galleryLimit is the default number of messages on the gallery page.
+	galleryLimit = 500
+)
+
+// runServe runs the serve command until ctx is done and returns the exit
+// code. Like the query commands it only reads the output directories.
+func runServe(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var dirs []string
+	fs.Func("dir", "output directory to show, may be repeated (default: the output directories of the config)", listFlag(&dirs))
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	_ = fs.Parse(args) // ExitOnError handles failures
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "serve takes no arguments, got %q\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+
+	g := &galleryServer{dirs: archiveDirs(dirs)}
+	if _, err := g.archive(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	srv := &http.Server{Addr: *addr, Handler: g.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	fmt.Fprintf(os.Stderr, "Serving %s at http://%s/\n", strings.Join(g.dirs, ", "), *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Failed to serve: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// galleryServer shows the recovered messages of output directories as web
+// pages. Only files belonging to a recovered message are served, never the
+// state or anything else in the output directories.
+type galleryServer struct {
+	dirs []string
+
+	mux     sync.Mutex
+	entries []archiveEntry
+	files   map[string]string // Media key -> file, see mediaKey
+	loaded  time.Time
+}
+
+func (g *galleryServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", g.serveGallery)
+	mux.HandleFunc("GET /media/{path...}", g.serveMedia)
+	return mux
+}
+
+// archive returns the recovered messages, reading them again if the last
+// read is older than galleryReload.
+func (g *galleryServer) archive() ([]archiveEntry, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if time.Since(g.loaded) < galleryReload {
+		return g.entries, nil
+	}
+	entries, err := loadArchive(g.dirs)
+	g.entries, g.loaded = entries, time.Now()
+	g.files = make(map[string]string)
+	for _, e := range entries {
+		if e.Path != "" {
+			g.files[g.mediaKey(e)] = e.Path
+		}
+	}
+	return entries, err
+}
+
+// mediaKey identifies the saved file of e: the index of its output directory
+// and the path inside it, with forward slashes.
+func (g *galleryServer) mediaKey(e archiveEntry) string {
+	index := 0
+	for i, dir := range g.dirs {
+		if dir == e.Dir {
+			index = i
+		}
+	}
+	rel, err := filepath.Rel(e.Dir, e.Path)
+	if err != nil {
+		rel = filepath.Base(e.Path)
+	}
+	return strconv.Itoa(index) + "/" + filepath.ToSlash(rel)
+}
+
+// mediaURL returns the URL path of the saved file of e. Each segment of its
+// key is escaped, so names like "Track #1.mp3" aren't cut at the "#".
+func (g *galleryServer) mediaURL(e archiveEntry) string {
+	segments := strings.Split(g.mediaKey(e), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/media/" + strings.Join(segments, "/")
+}
+
+func (g *galleryServer) serveMedia(w http.ResponseWriter, r *http.Request) {
+	if _, err := g.archive(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	g.mux.Lock()
+	path, ok := g.files[r.PathValue("path")] // Unescaped, like the keys
+	g.mux.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Has("download") {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+	}
+	http.ServeFile(w, r, path)
+}
+
+// Gallery page model: channels, days of deletion, senders, messages.
+type (
+	galleryPage struct {
+		Query    url.Values
+		Kinds    []string
+		Error    string
+		Shown    int
+		Total    int
+		Channels []*galleryChannel
+	}
+	galleryChannel struct {
+		Name string
+		Days []*galleryDay
+	}
+	galleryDay struct {
+		Date    string
+		Senders []*gallerySender
+	}
+	gallerySender struct {
+		Name     string
+		Messages []*galleryMessage
+	}
+	galleryMessage struct {
+		ID      int
+		Kind    string
+		Posted  string
+		Deleted string
+		Deleter string
+		Text    string
+		Files   []galleryFile
+	}
+	galleryFile struct {
+		URL      string
+		Name     string
+		Size     string
+		Preview  string // image, video, audio or empty
+		Degraded bool
+	}
+)
+
+func (g *galleryServer) serveGallery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := &galleryPage{Query: q, Kinds: messageKinds}
+	filter := archiveFilter{
+		channel: q.Get("channel"),
+		sender:  q.Get("sender"),
+		deleter: q.Get("deleter"),
+		text:    q.Get("text"),
+	}
+	if kinds := q.Get("type"); kinds != "" {
+		filter.kinds = strings.Split(kinds, ",")
+	}
+	limit := galleryLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+
+	entries, err := g.archive()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if err := filter.parse(q.Get("since"), q.Get("until")); err != nil {
+		page.Error = "Invalid " + err.Error()
+	} else {
+		var matched []archiveEntry
+		for _, e := range entries {
+			if filter.match(e) {
+				matched = append(matched, e)
+			}
+		}
+		g.group(page, matched, limit)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, page); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render the gallery: %v\n", err)
+	}
+}
+
+// group fills the page with the limit most recently deleted messages of
+// entries, newest first.
+func (g *galleryServer) group(page *galleryPage, entries []archiveEntry, limit int) {
+	page.Total = countMessages(entries)
+	var (
+		channels = make(map[string]*galleryChannel)
+		days     = make(map[string]*galleryDay)
+		senders  = make(map[string]*gallerySender)
+		messages = make(map[string]*galleryMessage)
+	)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		id := e.messageID()
+		msg, ok := messages[id]
+		if !ok {
+			if page.Shown == limit {
+				continue // Files of shown messages may still follow
+			}
+			page.Shown++
+			channelKey := e.Dir + "|" + e.channel()
+			ch, ok := channels[channelKey]
+			if !ok {
+				ch = &galleryChannel{Name: e.channel()}
+				channels[channelKey] = ch
+				page.Channels = append(page.Channels, ch)
+			}
+			date := e.deletedAt().Local().Format(time.DateOnly)
+			dayKey := channelKey + "|" + date
+			day, ok := days[dayKey]
+			if !ok {
+				day = &galleryDay{Date: date}
+				days[dayKey] = day
+				ch.Days = append(ch.Days, day)
+			}
+			sender := orDash(e.sender())
+			senderKey := dayKey + "|" + sender
+			s, ok := senders[senderKey]
+			if !ok {
+				s = &gallerySender{Name: sender}
+				senders[senderKey] = s
+				day.Senders = append(day.Senders, s)
+			}
+			msg = &galleryMessage{
+				ID:      e.Meta.MsgID,
+				Kind:    e.Kind,
+				Posted:  formatLocal(e.Meta.Date),
+				Deleted: formatLocal(e.Meta.Deletion.DeletedAt),
+				Text:    e.Meta.Text,
+			}
+			if d := e.deleter(); d != nil {
+				msg.Deleter = d.label()
+			}
+			messages[id] = msg
+			s.Messages = append(s.Messages, msg)
+		}
+		if e.Path != "" {
+			// Entries are walked backwards, keep the files in their order.
+			msg.Files = append([]galleryFile{g.file(e)}, msg.Files...)
+		}
+	}
+}
+
+func (g *galleryServer) file(e archiveEntry) galleryFile {
+	f := galleryFile{URL: g.mediaURL(e), Name: filepath.Base(e.Path), Preview: previewOf(e)}
+	if size := e.size(); size > 0 {
+		f.Size = formatSize(size)
+	}
+	if e.Meta.File != nil {
+		f.Degraded = e.Meta.File.Degraded
+	}
+	return f
+}
+
+// previewOf returns how a browser can show the saved file of e inline.
+func previewOf(e archiveEntry) string {
+	mimeType := mimeTypeOf(e)
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	default:
+		return ""
+	}
+}
+
+// mimeTypeOf returns the MIME type of the saved file of e.
+func mimeTypeOf(e archiveEntry) string {
+	if f := e.Meta.File; f != nil {
+		if f.Media == "photo" {
+			return "image/jpeg"
+		}
+		if f.MimeType != "" {
+			return f.MimeType
+		}
+	}
+	if t := mime.TypeByExtension(filepath.Ext(e.Path)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Deleted messages</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0 auto; max-width: 1200px; padding: 1em; background: #f4f4f5; color: #18181b; }
+form { display: flex; flex-wrap: wrap; gap: .5em; margin-bottom: 1em; }
+form input, form select { padding: .3em; }
+h2 { border-bottom: 2px solid #3b82f6; padding-bottom: .2em; }
+h3 { color: #52525b; }
+h4 { margin: .8em 0 .4em; }
+.messages { display: grid; grid-template-columns: repeat(auto-fill, minmax(260px, 1fr)); gap: .8em; }
+.message { background: #fff; border-radius: 8px; padding: .6em; box-shadow: 0 1px 2px #0002; overflow-wrap: anywhere; }
+.message img, .message video { width: 100%; max-height: 320px; object-fit: contain; background: #000; border-radius: 4px; }
+.message audio { width: 100%; }
+.meta { font-size: .8em; color: #71717a; }
+.deleted { font-size: .8em; color: #b91c1c; }
+.text { white-space: pre-wrap; margin: .4em 0; }
+.file { font-size: .85em; margin: .3em 0; }
+.degraded { color: #b45309; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+<h1>Deleted messages</h1>
+<form method="get">
+<input name="channel" placeholder="Channel" value="{{.Query.Get "channel"}}">
+<input name="sender" placeholder="Sender" value="{{.Query.Get "sender"}}">
+<input name="deleter" placeholder="Deleted by" value="{{.Query.Get "deleter"}}">
+<select name="type"><option value="">All types</option>{{$type := .Query.Get "type"}}{{range .Kinds}}<option{{if eq . $type}} selected{{end}}>{{.}}</option>{{end}}</select>
+<input name="since" placeholder="Since (2024-01-31, 24h)" value="{{.Query.Get "since"}}">
+<input name="until" placeholder="Until" value="{{.Query.Get "until"}}">
+<input name="text" placeholder="Text" value="{{.Query.Get "text"}}">
+<button>Filter</button>
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<p class="meta">{{if lt .Shown .Total}}Showing the {{.Shown}} most recently deleted of {{.Total}} messages.{{else}}{{.Total}} messages.{{end}}</p>
+{{range .Channels}}
+<h2>{{.Name}}</h2>
+{{range .Days}}
+<h3>{{.Date}}</h3>
+{{range .Senders}}
+<h4>{{.Name}}</h4>
+<div class="messages">
+{{range .Messages}}
+<div class="message">
+<div class="meta">#{{.ID}} · {{.Kind}} · posted {{.Posted}}</div>
+<div class="deleted">Deleted {{.Deleted}}{{if .Deleter}} by {{.Deleter}}{{end}}</div>
+{{range .Files}}
+{{if eq .Preview "image"}}<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Name}}" loading="lazy"></a>
+{{else if eq .Preview "video"}}<video src="{{.URL}}" controls preload="metadata"></video>
+{{else if eq .Preview "audio"}}<audio src="{{.URL}}" controls preload="none"></audio>
+{{end}}
+<div class="file"><a href="{{.URL}}?download">{{.Name}}</a>{{if .Size}} · {{.Size}}{{end}}{{if .Degraded}} · <span class="degraded">preview only</span>{{end}}</div>
+{{end}}
+{{if .Text}}<div class="text">{{.Text}}</div>{{end}}
+</div>
+{{end}}
+</div>
+{{end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestGalleryServer(t *testing.T) {
+	dir := writeTestArchive(t)
+	// Characters that end or escape a URL path must reach the file.
+	track := filepath.Join(dir, "@alice (111)", "Track #1 100%?.mp3")
+	if err := os.WriteFile(track, []byte("mp3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg := &tg.Message{ID: 7, PeerID: &tg.PeerChannel{ChannelID: 100}, Media: &tg.MessageMediaDocument{Document: &tg.Document{
+		MimeType:   "audio/mpeg",
+		Attributes: []tg.DocumentAttributeClass{&tg.DocumentAttributeAudio{}},
+	}}}
+	meta, err := newMessageMetadata(msg, chatMeta{Kind: kindChannel.String(), ID: 100, Ref: "@news"}, sourceAdminLog, deletionMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.File = &fileMeta{Name: filepath.Base(track), Size: 3, Media: "document", MimeType: "audio/mpeg"}
+	if err := writeMetadata(track, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer((&galleryServer{dirs: []string{dir}}).handler())
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint:errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	code, page := get("/")
+	if code != http.StatusOK {
+		t.Fatalf("GET / returned %d", code)
+	}
+	for _, want := range []string{
+		"@news", "2024-05-02", "@alice (111)", "sunset", "by @mod (222)", "hello world",
+		`<img src="/media/0/@alice%20%28111%29/photo.jpg"`, "<video", "5 messages.",
+		`<audio src="/media/0/@alice%20%28111%29/Track%20%231%20100%25%3F.mp3"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("gallery doesn't contain %q:\n%s", want, page)
+		}
+	}
+	if _, page := get("/?deleter=@mod&type=photo"); !strings.Contains(page, "1 messages.") || strings.Contains(page, "hello world") {
+		t.Errorf("filtered gallery:\n%s", page)
+	}
+
+	if code, body := get("/media/0/@alice%20%28111%29/photo.jpg"); code != http.StatusOK || body != "jpeg" {
+		t.Errorf("GET photo returned %d %q", code, body)
+	}
+	if code, body := get("/media/0/@alice%20%28111%29/Track%20%231%20100%25%3F.mp3"); code != http.StatusOK || body != "mp3" {
+		t.Errorf("GET track returned %d %q", code, body)
+	}
+	for _, path := range []string{
+		"/media/0/@alice%20%28111%29/Track%20#1%20100%25%3F.mp3", // Unescaped "#"
+		"/media/0/@alice%20%28111%29/poll.json",                  // Not a recovered file
+		"/media/0/.state/entities.json",
+		"/media/0/../../etc/passwd",
+	} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, want 404", path, code)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stateDirName is the directory inside a channel's output directory holding scan state.
+const stateDirName = ".state"
+
+// channelState is the persisted admin-log cursor of a channel.
+type channelState struct {
+	ChannelID   int64     `json:"channel_id"`
+	LastEventID int64     `json:"last_event_id"` // Highest admin-log event ID already processed
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// statePath returns the state file of a channel. Several channels may share
+// an output directory, so the file is named after the channel ID.
+func statePath(outputDir string, channelID int64) string {
+	return filepath.Join(outputDir, stateDirName, fmt.Sprintf("channel_%d.json", channelID))
+}
+
+// loadState reads the channel state. A missing file yields an empty state.
+func loadState(path string) (channelState, error) {
+	var st channelState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return st, nil
+}
+
+// loadCursor reads the channel state like loadState. The state directory may
+// have been lost, then the cursor is restored from the catalogue cat, which
+// is nil if there is none.
+func loadCursor(path string, channelID int64, cat *catalog, log *zap.Logger) (channelState, error) {
+	st, err := loadState(path)
+	if err != nil || st.LastEventID != 0 {
+		return st, err
+	}
+	if id, err := cat.cursor(channelID); err != nil {
+		log.Warn("Failed to read cursor from the catalogue", zap.Error(err))
+	} else if id != 0 {
+		log.Info("Restored admin log cursor from the catalogue", zap.Int64("last_event_id", id))
+		st.ChannelID, st.LastEventID = channelID, id
+	}
+	return st, nil
+}
+
+// saveState writes the channel state via a temporary file so an interrupted
+// write never leaves a corrupt cursor behind.
+func saveState(path string, st channelState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, creating the parent directory if needed.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
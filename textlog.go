@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// textLogDirName is the directory inside an output directory holding the
+// logs of deleted text messages, one JSONL and one Markdown file per chat.
+const textLogDirName = "deleted_messages"
+
+var (
+	textLogMux  sync.Mutex
+	textLogSeen = make(map[string]map[int]bool) // JSONL path -> logged message IDs
+)
+
+// textLogPath returns the log of a chat without extension.
+func textLogPath(outputDir string, chat chatMeta) string {
+	return filepath.Join(outputDir, textLogDirName, fmt.Sprintf("%s_%d", chat.Kind, chat.ID))
+}
+
+// appendDeletedText appends a deleted text message to the JSONL and Markdown
+// logs of its chat. Messages already in the log, e.g. from a -full scan, are
+// skipped; the returned bool reports whether meta was appended.
+func appendDeletedText(outputDir string, meta *messageMetadata) (bool, error) {
+	textLogMux.Lock()
+	defer textLogMux.Unlock()
+
+	base := textLogPath(outputDir, meta.Chat)
+	jsonPath, mdPath := base+".jsonl", base+".md"
+	seen, ok := textLogSeen[jsonPath]
+	if !ok {
+		var err error
+		if seen, err = loggedMessageIDs(jsonPath); err != nil {
+			return false, err
+		}
+		textLogSeen[jsonPath] = seen
+	}
+	if seen[meta.MsgID] {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return false, fmt.Errorf("failed to create text log directory: %w", err)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode message: %w", err)
+	}
+	if err := appendFile(jsonPath, append(data, '\n')); err != nil {
+		return false, err
+	}
+	seen[meta.MsgID] = true
+
+	entry := markdownEntry(meta)
+	if !fileExists(mdPath) {
+		entry = markdownHeader(meta.Chat) + entry
+	}
+	if err := appendFile(mdPath, []byte(entry)); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// saveDeletedText adds a deleted text message to the text log of its chat.
+func saveDeletedText(outputDir string, meta *messageMetadata, log *zap.Logger) error {
+	added, err := appendDeletedText(outputDir, meta)
+	if err != nil {
+		return err
+	}
+	if added {
+		log.Info("Saved deleted text message", zap.Int("msg_id", meta.MsgID), zap.String("path", textLogPath(outputDir, meta.Chat)+".md"))
+	} else {
+		log.Debug("Deleted text message already logged", zap.Int("msg_id", meta.MsgID))
+	}
+	return nil
+}
+
+// loggedMessageIDs reads the message IDs already present in a JSONL log.
+func loggedMessageIDs(path string) (map[int]bool, error) {
+	seen := make(map[int]bool)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return seen, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close() // nolint:errcheck
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024) // Lines hold the whole message
+	for scanner.Scan() {
+		var rec struct {
+			MsgID int `json:"msg_id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			seen[rec.MsgID] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return seen, nil
+}
+
+func appendFile(path string, data []byte) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := out.Write(data); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return out.Close()
+}
+
+func markdownHeader(chat chatMeta) string {
+	title := chat.Title
+	if title == "" {
+		title = chat.Ref
+	}
+	return fmt.Sprintf("# Deleted messages: %s (%s %d)\n\n", escapeMarkdown(title), chat.Kind, chat.ID)
+}
+
+// markdownEntry formats one deleted message of the Markdown log.
+func markdownEntry(meta *messageMetadata) string {
+	const layout = "2006-01-02 15:04:05 UTC"
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s · message %d\n\n", meta.Date.Format(layout), meta.MsgID)
+	if meta.Sender != nil {
+		fmt.Fprintf(&b, "- From: %s", escapeMarkdown(meta.Sender.label()))
+		if meta.Author != "" {
+			fmt.Fprintf(&b, " (%s)", escapeMarkdown(meta.Author))
+		}
+		b.WriteString("\n")
+	} else if meta.Author != "" {
+		fmt.Fprintf(&b, "- From: %s\n", escapeMarkdown(meta.Author))
+	}
+	if meta.EditDate != nil {
+		fmt.Fprintf(&b, "- Edited: %s\n", meta.EditDate.Format(layout))
+	}
+	if meta.ReplyTo != nil && meta.ReplyTo.MsgID != 0 {
+		fmt.Fprintf(&b, "- Reply to: message %d\n", meta.ReplyTo.MsgID)
+	}
+	if fwd := meta.Forward; fwd != nil {
+		switch {
+		case fwd.From != nil:
+			fmt.Fprintf(&b, "- Forwarded from: %s %d\n", fwd.From.Kind, fwd.From.ID)
+		case fwd.FromName != "":
+			fmt.Fprintf(&b, "- Forwarded from: %s\n", escapeMarkdown(fwd.FromName))
+		}
+	}
+	fmt.Fprintf(&b, "- Deleted: %s", meta.Deletion.DeletedAt.Format(layout))
+	if d := meta.Deletion.Deleter; d != nil {
+		fmt.Fprintf(&b, " by %s", escapeMarkdown(d.label()))
+	} else if meta.Deletion.DeletedBy != 0 {
+		fmt.Fprintf(&b, " by user %d", meta.Deletion.DeletedBy)
+	}
+	if meta.Deletion.EventID != 0 {
+		fmt.Fprintf(&b, " (admin log event %d)", meta.Deletion.EventID)
+	}
+	b.WriteString("\n\n")
+	b.WriteString(meta.Markdown)
+	b.WriteString("\n\n---\n\n")
+	return b.String()
+}
+
+// markdownEscaper escapes characters with a meaning in Markdown.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`,
+	"[", `\[`, "]", `\]`, "|", `\|`, "<", `\<`, ">", `\>`, "#", `\#`,
+)
+
+// markdownURLEscaper percent-escapes the characters that would end a link
+// destination early or start markup inside it.
+var markdownURLEscaper = strings.NewReplacer(
+	" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E",
+	"\n", "%0A", "\r", "%0D", "\t", "%09", `\`, "%5C",
+)
+
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// markdownMarkers returns the opening and closing Markdown of an entity.
+// Entities without a Markdown equivalent (mentions, hashtags, plain URLs, …)
+// are kept as plain text.
+func markdownMarkers(e tg.MessageEntityClass) (string, string) {
+	switch e := e.(type) {
+	case *tg.MessageEntityBold:
+		return "**", "**"
+	case *tg.MessageEntityItalic:
+		return "_", "_"
+	case *tg.MessageEntityUnderline:
+		return "<u>", "</u>"
+	case *tg.MessageEntityStrike:
+		return "~~", "~~"
+	case *tg.MessageEntitySpoiler:
+		return "||", "||"
+	case *tg.MessageEntityCode:
+		return "`", "`"
+	case *tg.MessageEntityPre:
+		return "```" + e.Language + "\n", "\n```"
+	case *tg.MessageEntityTextURL:
+		return "[", "](" + markdownURLEscaper.Replace(e.URL) + ")"
+	case *tg.MessageEntityMentionName:
+		return "[", fmt.Sprintf("](tg://user?id=%d)", e.UserID)
+	case *tg.MessageEntityBlockquote:
+		return "<blockquote>", "</blockquote>"
+	default:
+		return "", ""
+	}
+}
+
+// renderMarkdown renders text with its entities as Markdown.
+func renderMarkdown(text string, entities []tg.MessageEntityClass) string {
+	markers := make([]textMarker, 0, len(entities))
+	for _, e := range entities {
+		open, close := markdownMarkers(e)
+		if open == "" {
+			continue
+		}
+		_, pre := e.(*tg.MessageEntityPre)
+		_, code := e.(*tg.MessageEntityCode)
+		markers = append(markers, textMarker{open: open, close: close, start: e.GetOffset(), end: e.GetOffset() + e.GetLength(), code: pre || code})
+	}
+	return renderEntities(text, markers, escapeMarkdown)
+}
+
+// textMarker is the markup around the text of one entity.
+type textMarker struct {
+	open, close string
+	start, end  int  // UTF-16 code units
+	code        bool // No escaping inside
+}
+
+// renderEntities adds the markup of markers to text and escapes the rest.
+// Entity offsets and lengths count UTF-16 code units, as in the Telegram API.
+func renderEntities(text string, markers []textMarker, escape func(string) string) string {
+	units := utf16.Encode([]rune(text))
+	markers = slices.DeleteFunc(slices.Clone(markers), func(m textMarker) bool {
+		return m.start < 0 || m.end > len(units) || m.start >= m.end
+	})
+	if len(markers) == 0 {
+		return escape(text)
+	}
+	// Outer entities first, so they are opened before and closed after inner ones.
+	sort.SliceStable(markers, func(i, j int) bool {
+		if markers[i].start != markers[j].start {
+			return markers[i].start < markers[j].start
+		}
+		return markers[i].end > markers[j].end
+	})
+
+	var (
+		b     strings.Builder
+		open  []textMarker // Currently open, innermost last
+		next  int          // Next marker to open
+		code  int          // Open code entities
+		chunk []uint16
+	)
+	flush := func() {
+		s := string(utf16.Decode(chunk))
+		if code == 0 {
+			s = escape(s)
+		}
+		b.WriteString(s)
+		chunk = chunk[:0]
+	}
+	for i := 0; i <= len(units); i++ {
+		for len(open) > 0 && open[len(open)-1].end <= i {
+			flush()
+			m := open[len(open)-1]
+			open = open[:len(open)-1]
+			b.WriteString(m.close)
+			if m.code {
+				code--
+			}
+		}
+		for next < len(markers) && markers[next].start == i {
+			flush()
+			m := markers[next]
+			next++
+			if len(open) > 0 && m.end > open[len(open)-1].end {
+				m.end = open[len(open)-1].end // Overlapping entity, clip to keep nesting valid
+			}
+			open = append(open, m)
+			b.WriteString(m.open)
+			if m.code {
+				code++
+			}
+		}
+		if i < len(units) {
+			chunk = append(chunk, units[i])
+		}
+	}
+	flush()
+	return b.String()
+}
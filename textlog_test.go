@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		text     string
+		entities []tg.MessageEntityClass
+		want     string
+	}{
+		{"1 * 2 = [x]", nil, `1 \* 2 = \[x\]`},
+		{"bold text", []tg.MessageEntityClass{&tg.MessageEntityBold{Offset: 0, Length: 4}}, "**bold** text"},
+		{
+			"see docs",
+			[]tg.MessageEntityClass{&tg.MessageEntityTextURL{Offset: 4, Length: 4, URL: "https://example.com/a b"}},
+			"see [docs](https://example.com/a%20b)",
+		},
+		{
+			// A ")" would end the link and let the rest inject markup.
+			"wiki",
+			[]tg.MessageEntityClass{&tg.MessageEntityTextURL{Offset: 0, Length: 4, URL: "https://en.wikipedia.org/wiki/Go_(language)) ![x](https://evil)"}},
+			"[wiki](https://en.wikipedia.org/wiki/Go_%28language%29%29%20![x]%28https://evil%29)",
+		},
+		{"x_y", []tg.MessageEntityClass{&tg.MessageEntityCode{Offset: 0, Length: 3}}, "`x_y`"},
+		// Offsets count UTF-16 code units: the emoji takes two.
+		{"😀 hi", []tg.MessageEntityClass{&tg.MessageEntityItalic{Offset: 3, Length: 2}}, "😀 _hi_"},
+		// Entities out of range are ignored.
+		{"hi", []tg.MessageEntityClass{&tg.MessageEntityBold{Offset: 1, Length: 5}}, "hi"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.text, tt.entities); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gotd/td/telegram/thumbnail"
+	"github.com/gotd/td/tg"
+	"go.uber.org/zap"
+)
+
+// thumbnailTargets returns the previews of msg's media, saved next to the
+// main file as <name>.thumb_<type>.<ext>: the other sizes of a photo, the
+// thumbnails and video previews of a document, and the stripped and cached
+// previews embedded in the message, expanded into regular JPEGs.
+func thumbnailTargets(msg *tg.Message, main *mediaTarget, log *zap.Logger) []*mediaTarget {
+	base := strings.TrimSuffix(main.baseFilename, filepath.Ext(main.baseFilename))
+	target := func(kind, ext string, loc tg.InputFileLocationClass, content []byte) *mediaTarget {
+		name := fmt.Sprintf("%s.thumb_%s.%s", base, sanitize(kind), ext)
+		return &mediaTarget{
+			loc:          loc,
+			content:      content,
+			dcID:         main.dcID,
+			baseFilename: name,
+			subDir:       main.subDir,
+			destPath:     filepath.Join(main.subDir, name),
+		}
+	}
+
+	var (
+		targets []*mediaTarget
+		sizes   []tg.PhotoSizeClass
+		sizeLoc func(kind string) tg.InputFileLocationClass
+	)
+	switch m := msg.Media.(type) {
+	case *tg.MessageMediaPhoto:
+		photo, ok := m.Photo.AsNotEmpty()
+		if !ok {
+			return nil
+		}
+		sizes = photo.Sizes
+		sizeLoc = func(kind string) tg.InputFileLocationClass {
+			return &tg.InputPhotoFileLocation{ID: photo.ID, AccessHash: photo.AccessHash, FileReference: photo.FileReference, ThumbSize: kind}
+		}
+	case *tg.MessageMediaDocument:
+		doc, ok := m.Document.AsNotEmpty()
+		if !ok {
+			return nil
+		}
+		sizes = doc.Thumbs
+		sizeLoc = func(kind string) tg.InputFileLocationClass {
+			return &tg.InputDocumentFileLocation{ID: doc.ID, AccessHash: doc.AccessHash, FileReference: doc.FileReference, ThumbSize: kind}
+		}
+		for _, v := range doc.VideoThumbs {
+			if video, ok := v.(*tg.VideoSize); ok {
+				targets = append(targets, target(video.Type, "mp4", sizeLoc(video.Type), nil))
+			}
+		}
+	default:
+		return nil
+	}
+
+	mainType := ""
+	if loc, ok := main.loc.(*tg.InputPhotoFileLocation); ok {
+		mainType = loc.ThumbSize // Already saved as the main file
+	}
+	for _, s := range sizes {
+		switch size := s.(type) {
+		case *tg.PhotoSize:
+			if size.Type != mainType {
+				targets = append(targets, target(size.Type, "jpg", sizeLoc(size.Type), nil))
+			}
+		case *tg.PhotoSizeProgressive:
+			if size.Type != mainType {
+				targets = append(targets, target(size.Type, "jpg", sizeLoc(size.Type), nil))
+			}
+		case *tg.PhotoCachedSize:
+			targets = append(targets, target(size.Type, "jpg", nil, size.Bytes))
+		case *tg.PhotoStrippedSize:
+			data, err := thumbnail.Expand(size.Bytes)
+			if err != nil {
+				log.Debug("Failed to expand stripped preview", zap.Int("msg_id", msg.ID), zap.Error(err))
+				continue
+			}
+			targets = append(targets, target(size.Type, "jpg", nil, data))
+		}
+	}
+	return targets
+}
+
+// saveThumbnails saves the previews of msg's media, see thumbnailTargets.
+// Previews are a bonus, so failures are only logged.
+func saveThumbnails(ctx context.Context, f *fetcher, msg *tg.Message, dest mediaDest, log *zap.Logger) {
+	main, err := newMediaTarget(msg, dest, log)
+	if err != nil || main.loc == nil {
+		return
+	}
+	for _, t := range thumbnailTargets(msg, main, log) {
+		if err := t.save(ctx, f, msg, nil, nil, log); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			log.Warn("Failed to save thumbnail", zap.String("path", t.destPath), zap.Error(err))
+		}
+	}
+}
+
+// previewSuffix replaces the extension of a photo that could only be
+// recovered from its embedded preview.
+const previewSuffix = ".preview.jpg"
+
+// embeddedPreview returns the best preview embedded in the photo sizes,
+// which needs no download: the cached size if present, otherwise the
+// expanded stripped size.
+func embeddedPreview(sizes []tg.PhotoSizeClass) (kind string, data []byte) {
+	for _, s := range sizes {
+		if cached, ok := s.(*tg.PhotoCachedSize); ok && len(cached.Bytes) > 0 {
+			return "cached_preview", cached.Bytes
+		}
+	}
+	for _, s := range sizes {
+		if stripped, ok := s.(*tg.PhotoStrippedSize); ok {
+			if data, err := thumbnail.Expand(stripped.Bytes); err == nil {
+				return "stripped_preview", data
+			}
+		}
+	}
+	return "", nil
+}
+
+// savePreviewFallback saves the preview embedded in a photo message after the
+// photo itself failed to download and isn't on disk, so at least a low-resolution copy is
+// recovered. The metadata marks the file as degraded. The preview uses its
+// own name, so a later successful download still saves the full photo.
+func savePreviewFallback(ctx context.Context, f *fetcher, msg *tg.Message, main *mediaTarget, meta *messageMetadata, cause error, log *zap.Logger) {
+	if failureReasonOf(cause) == reasonCanceled {
+		return
+	}
+	if fileExists(main.destPath) {
+		return // The photo was saved, only writing its metadata failed
+	}
+	media, ok := msg.Media.(*tg.MessageMediaPhoto)
+	if !ok {
+		return
+	}
+	photo, ok := media.Photo.AsNotEmpty()
+	if !ok {
+		return
+	}
+	kind, data := embeddedPreview(photo.Sizes)
+	if data == nil {
+		return
+	}
+
+	name := strings.TrimSuffix(main.baseFilename, filepath.Ext(main.baseFilename)) + previewSuffix
+	preview := &mediaTarget{
+		content:      data,
+		baseFilename: name,
+		subDir:       main.subDir,
+		destPath:     filepath.Join(main.subDir, name),
+		outputDir:    main.outputDir,
+		fallback:     kind,
+		fallbackErr:  cause.Error(),
+	}
+	if meta != nil {
+		previewMeta := *meta
+		meta = &previewMeta
+	}
+	if err := preview.save(ctx, f, msg, nil, meta, log); err != nil {
+		log.Warn("Failed to save embedded preview", zap.Int("msg_id", msg.ID), zap.Error(err))
+		return
+	}
+	log.Warn("Photo could not be downloaded, saved its low-resolution preview instead", zap.Int("msg_id", msg.ID), zap.String("path", preview.destPath), zap.String("fallback", kind))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"go.uber.org/zap"
+)
+
+// watchedChannel is the polling state of a channel in watch mode.
+type watchedChannel struct {
+	cfg      ChannelConfig
+	peer     *resolvedPeer // nil until resolved, reset after a failed scan
+	idle     bool          // No admin log to poll (basic group, private chat)
+	interval time.Duration
+	next     time.Time
+	log      *zap.Logger
+}
+
+// watchChannels polls the admin log of every channel on its interval until ctx
+// is cancelled. Each poll uses the persisted cursor, so only new delete events
+// are handled. Errors are logged and retried on the next poll instead of
+// stopping the process. If capture is set, resolved chats are also followed
+// in real time, which is the only option for basic groups and private chats.
+func watchChannels(ctx context.Context, client *telegram.Client, f *fetcher, channels []ChannelConfig, capture *realtimeCapture, opts runOptions, log *zap.Logger) error {
+	watched := make([]*watchedChannel, 0, len(channels))
+	for _, ch := range channels {
+		interval := ch.interval
+		if interval == 0 {
+			interval = opts.Interval
+		}
+		watched = append(watched, &watchedChannel{
+			cfg:      ch,
+			interval: interval,
+			log:      log.With(zap.Stringer("channel", ch.ref)),
+		})
+	}
+	log.Info("Watching channels for deleted media. Press Ctrl+C to stop.", zap.Int("channels", len(watched)), zap.Duration("default_interval", opts.Interval))
+
+	for {
+		for _, w := range watched {
+			if w.idle || time.Now().Before(w.next) {
+				continue
+			}
+			w.next = time.Now().Add(w.interval)
+
+			if w.peer == nil {
+				peer, err := lookupPeer(ctx, client.API(), w.cfg, w.log)
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err != nil {
+					w.log.Warn("Failed to resolve chat, will retry", zap.Error(err), zap.Time("next_attempt", w.next))
+					continue
+				}
+				w.peer = peer
+				if capture != nil {
+					capture.watch(ctx, peer, w.cfg)
+				}
+				if peer.Channel == nil {
+					// Nothing to poll, real-time capture is all we can do.
+					w.idle = true
+					if capture == nil {
+						w.log.Warn("Basic groups and private chats have no admin log, use -realtime to capture them. Ignoring.")
+					}
+					continue
+				}
+			}
+
+			total, err := scanChannel(ctx, client, f, w.cfg, w.peer.Channel, opts, w.log)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				w.log.Warn("Failed to poll admin log, will retry", zap.Error(err), zap.Time("next_attempt", w.next))
+				w.peer = nil // Resolve again in case the channel changed
+				continue
+			}
+			if total > 0 {
+				w.log.Info("Saved new deleted media.", zap.Int("total_files_potentially_saved", total))
+			} else {
+				w.log.Debug("No new deleted media.")
+			}
+		}
+		// -full only applies to the first pass, later polls continue from the cursor.
+		opts.Full = false
+
+		var next time.Time
+		for _, w := range watched {
+			if !w.idle && (next.IsZero() || w.next.Before(next)) {
+				next = w.next
+			}
+		}
+		if next.IsZero() {
+			// Only real-time chats left, wait for shutdown.
+			<-ctx.Done()
+			log.Info("Stopping watch mode...")
+			return nil
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info("Stopping watch mode...")
+			return nil
+		case <-timer.C:
+		}
+	}
+}